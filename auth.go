@@ -0,0 +1,349 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// the authPrincipal of a request in the gin context
+const authPrincipalKey = "s3pal.principal"
+
+// what a key, user or token may do on the server
+var authOperations = []string{"upload", "list", "read", "kv_read", "kv_write"}
+
+var (
+	errAuthRequired = errors.New("authentication required")
+	errInvalidKey   = errors.New("invalid API key")
+	errInvalidLogin = errors.New("invalid user name or password")
+	errInvalidToken = errors.New("invalid token")
+	errTokenExpired = errors.New("token expired")
+)
+
+// authPrincipal is whoever made a request: an API key, a user or a token.
+// No prefixes or operations means everything.
+type authPrincipal struct {
+	Name       string
+	Prefixes   []string
+	Operations []string
+}
+
+func (p *authPrincipal) allowsOperation(operation string) bool {
+	return len(operation) == 0 || len(p.Operations) == 0 || StringInSlice(operation, p.Operations)
+}
+
+// allowsKey checks a key or prefix against the allowed prefixes. Keys with
+// .. parts are never allowed to a principal with prefixes, a filesystem
+// storage would resolve them outside of the prefix.
+func (p *authPrincipal) allowsKey(key string) bool {
+	if len(p.Prefixes) == 0 {
+		return true
+	}
+
+	for _, part := range strings.Split(key, "/") {
+		if part == ".." {
+			return false
+		}
+	}
+
+	for _, prefix := range p.Prefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// authToken is what the HMAC signed tokens carry
+type authToken struct {
+	Name       string   `json:"name,omitempty"`
+	Expires    int64    `json:"exp"`
+	Prefixes   []string `json:"prefixes,omitempty"`
+	Operations []string `json:"ops,omitempty"`
+}
+
+func tokenSignature(secret string, payload string) string {
+	return hex.EncodeToString(hmacSHA256([]byte(secret), payload))
+}
+
+// signAuthToken returns the payload, base64url encoded JSON without
+// padding, a dot and the hex HMAC-SHA256 of the payload with the secret
+func signAuthToken(secret string, token authToken) string {
+	data, _ := json.Marshal(token)
+	payload := strings.TrimRight(base64.URLEncoding.EncodeToString(data), "=")
+
+	return payload + "." + tokenSignature(secret, payload)
+}
+
+func parseAuthToken(secret string, s string, now time.Time) (*authToken, error) {
+	i := strings.LastIndex(s, ".")
+	if i < 0 {
+		return nil, errInvalidToken
+	}
+
+	payload := s[:i]
+	if !hmac.Equal([]byte(s[i+1:]), []byte(tokenSignature(secret, payload))) {
+		return nil, errInvalidToken
+	}
+
+	if n := len(payload) % 4; n > 0 {
+		payload += strings.Repeat("=", 4-n)
+	}
+
+	data, err := base64.URLEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, errInvalidToken
+	}
+
+	var token authToken
+	if err = json.Unmarshal(data, &token); err != nil || token.Expires == 0 {
+		return nil, errInvalidToken
+	}
+
+	if now.Unix() > token.Expires {
+		return nil, errTokenExpired
+	}
+
+	return &token, nil
+}
+
+// newAuthToken signs a token with server.auth.hmac_secret, valid for ttl
+func (s *S3pal) newAuthToken(name string, prefixes []string, operations []string, ttl time.Duration) (string, error) {
+	auth := s.Config.Server.Auth
+	if len(auth.HMACSecret) == 0 {
+		return "", fmt.Errorf("server.auth.hmac_secret is not set")
+	}
+
+	for _, operation := range operations {
+		if !StringInSlice(operation, authOperations) {
+			return "", fmt.Errorf("unknown operation '%s', valid are: %s", operation, strings.Join(authOperations, ", "))
+		}
+	}
+
+	token := authToken{
+		Name:       name,
+		Expires:    time.Now().Add(ttl).Unix(),
+		Prefixes:   prefixes,
+		Operations: operations,
+	}
+
+	return signAuthToken(auth.HMACSecret, token), nil
+}
+
+func (s *S3pal) authEnabled() bool {
+	auth := s.Config.Server.Auth
+	return len(auth.Keys) > 0 || len(auth.Users) > 0 || len(auth.HMACSecret) > 0
+}
+
+// checkAuthConfig catches typos in [server.auth] before the server starts
+func (s *S3pal) checkAuthConfig() error {
+	auth := s.Config.Server.Auth
+
+	var operations []string
+	for i, key := range auth.Keys {
+		if len(key.Key) == 0 {
+			return fmt.Errorf("server.auth.keys #%d has no key", i+1)
+		}
+		operations = append(operations, key.Operations...)
+	}
+
+	for i, user := range auth.Users {
+		if len(user.Name) == 0 || len(user.Password) == 0 {
+			return fmt.Errorf("server.auth.users #%d needs a name and a password", i+1)
+		}
+		operations = append(operations, user.Operations...)
+	}
+
+	for _, operation := range operations {
+		if !StringInSlice(operation, authOperations) {
+			return fmt.Errorf("unknown operation '%s' in server.auth, valid are: %s", operation, strings.Join(authOperations, ", "))
+		}
+	}
+
+	return nil
+}
+
+func secureCompare(a string, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+func (s *S3pal) keyPrincipal(value string) *authPrincipal {
+	for _, key := range s.Config.Server.Auth.Keys {
+		if secureCompare(value, key.Key) {
+			name := key.Name
+			if len(name) == 0 {
+				name = "key " + maskKey(key.Key)
+			}
+
+			return &authPrincipal{Name: name, Prefixes: key.Prefixes, Operations: key.Operations}
+		}
+	}
+
+	return nil
+}
+
+func (s *S3pal) tokenPrincipal(value string) (*authPrincipal, error) {
+	token, err := parseAuthToken(s.Config.Server.Auth.HMACSecret, value, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	name := token.Name
+	if len(name) == 0 {
+		name = "token"
+	}
+
+	return &authPrincipal{Name: name, Prefixes: token.Prefixes, Operations: token.Operations}, nil
+}
+
+// authenticate finds who made the request from, in this order, basic
+// auth, an Authorization: Bearer API key or token, an X-Api-Key header or
+// a token query parameter
+func (s *S3pal) authenticate(r *http.Request) (*authPrincipal, error) {
+	auth := s.Config.Server.Auth
+
+	if name, password, ok := r.BasicAuth(); ok {
+		for _, user := range auth.Users {
+			if secureCompare(name, user.Name) && secureCompare(password, user.Password) {
+				return &authPrincipal{Name: user.Name, Prefixes: user.Prefixes, Operations: user.Operations}, nil
+			}
+		}
+
+		return nil, errInvalidLogin
+	}
+
+	if header := r.Header.Get("Authorization"); strings.HasPrefix(header, "Bearer ") {
+		value := strings.TrimSpace(header[len("Bearer "):])
+		if principal := s.keyPrincipal(value); principal != nil {
+			return principal, nil
+		}
+
+		if len(auth.HMACSecret) == 0 {
+			return nil, errInvalidKey
+		}
+
+		return s.tokenPrincipal(value)
+	}
+
+	if value := r.Header.Get("X-Api-Key"); len(value) > 0 {
+		if principal := s.keyPrincipal(value); principal != nil {
+			return principal, nil
+		}
+
+		return nil, errInvalidKey
+	}
+
+	// only the query, reading the form would read the whole upload
+	if value := r.URL.Query().Get("token"); len(value) > 0 && len(auth.HMACSecret) > 0 {
+		return s.tokenPrincipal(value)
+	}
+
+	return nil, errAuthRequired
+}
+
+func (s *S3pal) authError(c *gin.Context, code int, reason string) {
+	if code == 401 {
+		if len(s.Config.Server.Auth.Users) > 0 {
+			realm := s.Config.Server.Auth.Realm
+			if len(realm) == 0 {
+				realm = "s3pal"
+			}
+			c.Writer.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", realm))
+		} else {
+			c.Writer.Header().Set("WWW-Authenticate", "Bearer")
+		}
+	}
+
+	response := map[string]string{
+		"status": "error",
+		"reason": reason,
+	}
+	c.JSON(code, response)
+	c.Abort()
+}
+
+// AuthMiddleware lets only requests allowed to do operation through (any
+// authenticated one when operation is empty). key returns the key or
+// prefix the request is about, which is checked against the allowed
+// prefixes. Handlers that make up the key check it with keyAllowed.
+// Everything goes through when server.auth is not set.
+func (s *S3pal) AuthMiddleware(operation string, key func(c *gin.Context) string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !s.authEnabled() {
+			c.Next()
+			return
+		}
+
+		principal, err := s.authenticate(c.Request)
+		if err != nil {
+			s.authError(c, 401, err.Error())
+			return
+		}
+
+		if !principal.allowsOperation(operation) {
+			log.Printf("%s may not %s\n", principal.Name, operation)
+			s.authError(c, 403, fmt.Sprintf("not allowed to %s", operation))
+			return
+		}
+
+		if key != nil && len(principal.Prefixes) > 0 {
+			if k := key(c); !principal.allowsKey(k) {
+				log.Printf("%s may not %s '%s'\n", principal.Name, operation, k)
+				s.authError(c, 403, fmt.Sprintf("not allowed to %s '%s'", operation, k))
+				return
+			}
+		}
+
+		if c.Keys == nil {
+			c.Keys = map[string]interface{}{}
+		}
+		c.Keys[authPrincipalKey] = principal
+
+		c.Next()
+	}
+}
+
+// keyAllowed checks a key the handler made up, like the one an upload is
+// written to, against the prefixes of whoever made the request. A key that
+// is not allowed gets the request a 403.
+func (s *S3pal) keyAllowed(c *gin.Context, operation string, key string) bool {
+	if !s.authEnabled() {
+		return true
+	}
+
+	principal, ok := c.Keys[authPrincipalKey].(*authPrincipal)
+	if ok && principal.allowsKey(key) {
+		return true
+	}
+
+	name := "nobody"
+	if ok {
+		name = principal.Name
+	}
+
+	log.Printf("%s may not %s '%s'\n", name, operation, key)
+	s.authError(c, 403, fmt.Sprintf("not allowed to %s '%s'", operation, key))
+	return false
+}
+
+func listPrefixKey(c *gin.Context) string {
+	return c.Request.FormValue("prefix")
+}
+
+func paramKey(c *gin.Context) string {
+	return strings.TrimPrefix(c.Params.ByName("key"), "/")
+}
+
+func (s *S3pal) kvObjectKey(c *gin.Context) string {
+	return s.kvPrefix() + paramKey(c)
+}
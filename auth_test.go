@@ -0,0 +1,135 @@
+package main
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuthToken(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	token := signAuthToken("secret", authToken{Name: "browser", Expires: now.Unix() + 60, Prefixes: []string{"uploads/"}})
+
+	parsed, err := parseAuthToken("secret", token, now)
+	assert.Nil(t, err)
+	assert.Equal(t, "browser", parsed.Name)
+	assert.Equal(t, []string{"uploads/"}, parsed.Prefixes)
+
+	_, err = parseAuthToken("other secret", token, now)
+	assert.Equal(t, errInvalidToken, err)
+
+	_, err = parseAuthToken("secret", "x"+token, now)
+	assert.Equal(t, errInvalidToken, err)
+
+	_, err = parseAuthToken("secret", token, now.Add(2*time.Minute))
+	assert.Equal(t, errTokenExpired, err)
+
+	_, err = parseAuthToken("secret", signAuthToken("secret", authToken{}), now)
+	assert.Equal(t, errInvalidToken, err)
+}
+
+func TestAuthPrincipalAllows(t *testing.T) {
+	p := &authPrincipal{Prefixes: []string{"uploads/", "kv/app/"}, Operations: []string{"upload", "kv_read"}}
+
+	assert.True(t, p.allowsOperation("upload"))
+	assert.True(t, p.allowsOperation(""))
+	assert.False(t, p.allowsOperation("list"))
+
+	assert.True(t, p.allowsKey("uploads/cat.jpg"))
+	assert.True(t, p.allowsKey("kv/app/setting"))
+	assert.False(t, p.allowsKey("kv/other"))
+	assert.False(t, p.allowsKey(""))
+	assert.False(t, p.allowsKey("uploads/../secret"))
+
+	assert.True(t, (&authPrincipal{}).allowsKey("anything"))
+}
+
+func TestAuthMiddleware(t *testing.T) {
+	s3pal := getS3palWithStorage(newMemStorage())
+	s3pal.Config.Server.Auth = AuthConfig{
+		Keys: []AuthKeyConfig{
+			{Key: "all"},
+			{Key: "uploader", Prefixes: []string{"uploads/"}, Operations: []string{"upload"}},
+		},
+		Users:      []AuthUserConfig{{Name: "jack", Password: "pw", Operations: []string{"list"}}},
+		HMACSecret: "secret",
+	}
+
+	gin.SetMode(gin.ReleaseMode)
+	r := gin.New()
+	ok := func(c *gin.Context) {
+		c.JSON(200, map[string]string{"status": "ok"})
+	}
+	// like the upload handlers, the key they write is checked
+	r.POST("/upload/url", s3pal.AuthMiddleware("upload", nil), func(c *gin.Context) {
+		if s3pal.keyAllowed(c, "upload", s3pal.makeFilename(c.Request.FormValue("prefix"), "cat.jpg")) {
+			ok(c)
+		}
+	})
+	r.GET("/list", s3pal.AuthMiddleware("list", listPrefixKey), ok)
+
+	token, err := s3pal.newAuthToken("", []string{"uploads/user1/"}, nil, time.Minute)
+	assert.Nil(t, err)
+
+	tests := []struct {
+		method string
+		url    string
+		header string
+		value  string
+		code   int
+	}{
+		{"GET", "/list", "", "", 401},
+		{"GET", "/list", "X-Api-Key", "wrong", 401},
+		{"GET", "/list", "X-Api-Key", "all", 200},
+		{"GET", "/list", "Authorization", "Bearer all", 200},
+		{"GET", "/list", "X-Api-Key", "uploader", 403},
+		{"POST", "/upload/url?prefix=uploads/x", "X-Api-Key", "uploader", 200},
+		// upload_name_format puts it under uploads/ already
+		{"POST", "/upload/url", "X-Api-Key", "uploader", 200},
+		{"POST", "/upload/url?prefix=uploads", "X-Api-Key", "uploader", 200},
+		{"POST", "/upload/url?prefix=other", "X-Api-Key", "uploader", 403},
+		{"POST", "/upload/url?prefix=uploads/../other", "X-Api-Key", "uploader", 403},
+		{"GET", "/list", "Authorization", "Basic amFjazpwdw==", 200},
+		{"GET", "/list", "Authorization", "Basic amFjazp4", 401},
+		{"POST", "/upload/url", "Authorization", "Basic amFjazpwdw==", 403},
+		{"POST", "/upload/url?prefix=uploads/user1&token=" + token, "", "", 200},
+		{"POST", "/upload/url?prefix=uploads/user2", "Authorization", "Bearer " + token, 403},
+		{"GET", "/list?token=" + token[1:], "", "", 401},
+	}
+
+	for _, test := range tests {
+		req, _ := http.NewRequest(test.method, test.url, nil)
+		if len(test.header) > 0 {
+			req.Header.Set(test.header, test.value)
+		}
+
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		assert.Equal(t, test.code, w.Code, test.url+" "+test.value)
+		if test.code == 401 {
+			assert.True(t, strings.HasPrefix(w.Header().Get("WWW-Authenticate"), "Basic"))
+			assert.Contains(t, w.Body.String(), `"status":"error"`)
+		}
+	}
+
+	s3pal.Config.Server.Auth = AuthConfig{}
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/list", nil)
+	r.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+}
+
+func TestCheckAuthConfig(t *testing.T) {
+	s3pal := getS3palWithStorage(newMemStorage())
+	assert.Nil(t, s3pal.checkAuthConfig())
+
+	s3pal.Config.Server.Auth.Keys = []AuthKeyConfig{{Key: "k", Operations: []string{"uplaod"}}}
+	assert.NotNil(t, s3pal.checkAuthConfig())
+
+	s3pal.Config.Server.Auth.Keys = []AuthKeyConfig{{Operations: []string{"upload"}}}
+	assert.NotNil(t, s3pal.checkAuthConfig())
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+)
+
+const defaultCopyConcurrency = 8
+
+// CopyStorage is implemented by backends that copy objects without the
+// data passing through s3pal (S3 PUT-copy).
+type CopyStorage interface {
+	// Copy copies srcKey of srcBucket to key. nil headers keep the
+	// source's metadata, otherwise they replace all of it.
+	Copy(srcBucket string, srcKey string, key string, headers http.Header, acl string) error
+}
+
+// ACLStorage is implemented by backends that can read an object's ACL
+// and set it on another, so copies keep it (S3 PUT-copy does not).
+type ACLStorage interface {
+	// GetACL returns the ACL of key in the backend's own format
+	GetACL(key string) ([]byte, error)
+	PutACL(key string, acl []byte) error
+}
+
+// headers S3 stores with an object and PUT-copy can set again
+var objectHeaderNames = []string{"Content-Type", "Cache-Control", "Content-Disposition", "Content-Encoding", "Content-Language", "Expires"}
+
+// objectHeaders picks the stored metadata out of a HEAD response
+func objectHeaders(headers http.Header) http.Header {
+	result := http.Header{}
+	for _, name := range objectHeaderNames {
+		if value := headers.Get(name); len(value) > 0 {
+			result.Set(name, value)
+		}
+	}
+
+	for name, values := range headers {
+		if strings.HasPrefix(strings.ToLower(name), "x-amz-meta-") {
+			result[name] = values
+		}
+	}
+
+	return result
+}
+
+// parseHeaders turns "Name:Value" arguments into headers
+func parseHeaders(args []string) (http.Header, error) {
+	headers := http.Header{}
+	for _, arg := range args {
+		i := strings.Index(arg, ":")
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid header '%s', use Name:Value", arg)
+		}
+
+		headers.Set(strings.TrimSpace(arg[:i]), strings.TrimSpace(arg[i+1:]))
+	}
+
+	return headers, nil
+}
+
+// parseS3Path splits "s3://bucket/key" into bucket and key. Anything else
+// is a key in defaultBucket.
+func parseS3Path(arg string, defaultBucket string) (string, string) {
+	if !strings.HasPrefix(arg, "s3://") {
+		return defaultBucket, arg
+	}
+
+	rest := arg[len("s3://"):]
+	i := strings.Index(rest, "/")
+	if i < 0 {
+		return rest, ""
+	}
+
+	return rest[:i], rest[i+1:]
+}
+
+type copyOptions struct {
+	// SetHeaders replace the matching headers of each object, all others
+	// are kept. Without them metadata is copied as is.
+	SetHeaders http.Header
+	ACL        string
+	Move       bool
+	Recursive  bool
+}
+
+// copyObject copies one object within or between buckets. src is the
+// storage of srcBucket. Without opts.ACL the copy gets the source's ACL.
+func copyObject(src Storage, srcBucket string, srcKey string, dst Storage, dstKey string, opts copyOptions) error {
+	var headers http.Header
+	if len(opts.SetHeaders) > 0 {
+		info, err := src.Head(srcKey)
+		if err != nil {
+			return err
+		}
+
+		headers = objectHeaders(info.Headers)
+		for name, values := range opts.SetHeaders {
+			headers[http.CanonicalHeaderKey(name)] = values
+		}
+	}
+
+	return copyACL(src, srcBucket, srcKey, dst, dstKey, headers, opts.ACL)
+}
+
+// copyACL copies an object like putCopy. Without acl the copy gets the
+// ACL of srcKey, when both storages can. The ACL is read first, a copy
+// onto itself resets it.
+func copyACL(src Storage, srcBucket string, srcKey string, dst Storage, dstKey string, headers http.Header, acl string) error {
+	from, ok := src.(ACLStorage)
+	to, ok2 := dst.(ACLStorage)
+	if len(acl) > 0 || !ok || !ok2 {
+		return putCopy(src, srcBucket, srcKey, dst, dstKey, headers, acl)
+	}
+
+	kept, err := from.GetACL(srcKey)
+	if err != nil {
+		return fmt.Errorf("could not read the ACL of %s: %v", srcKey, err)
+	}
+
+	if err = putCopy(src, srcBucket, srcKey, dst, dstKey, headers, ""); err != nil {
+		return err
+	}
+
+	if err = to.PutACL(dstKey, kept); err != nil {
+		return fmt.Errorf("could not keep the ACL of %s: %v", srcKey, err)
+	}
+
+	return nil
+}
+
+// putCopy copies an object server side if dst can, otherwise through
+// s3pal. nil headers keep the source's metadata.
+func putCopy(src Storage, srcBucket string, srcKey string, dst Storage, dstKey string, headers http.Header, acl string) error {
+	if copier, ok := dst.(CopyStorage); ok {
+		return copier.Copy(srcBucket, srcKey, dstKey, headers, acl)
+	}
+
+	info, err := src.Head(srcKey)
+	if err != nil {
+		return err
+	}
+
+	if headers == nil {
+		headers = objectHeaders(info.Headers)
+	}
+
+	rc, err := src.Get(srcKey)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	_, err = dst.Put(dstKey, rc, info.Size, headers, acl)
+	return err
+}
+
+// folderPrefix ends prefix with a single slash, the bucket's root stays
+// empty
+func folderPrefix(prefix string) string {
+	prefix = strings.TrimRight(prefix, "/")
+	if len(prefix) == 0 {
+		return ""
+	}
+
+	return prefix + "/"
+}
+
+// copyObjects copies (or moves) src to dst. src and dst are keys or
+// s3://bucket/key. With opts.Recursive they are prefixes and everything
+// under src is copied, keeping the rest of the keys.
+func (s *S3pal) copyObjects(src string, dst string, opts copyOptions) error {
+	srcBucket, srcKey := parseS3Path(src, s.Config.Aws.Bucket)
+	dstBucket, dstKey := parseS3Path(dst, s.Config.Aws.Bucket)
+
+	srcStorage := s.storageFor(srcBucket)
+	dstStorage := s.storageFor(dstBucket)
+
+	action := "Copied"
+	if opts.Move {
+		action = "Moved"
+	}
+
+	if !opts.Recursive {
+		if len(dstKey) == 0 || strings.HasSuffix(dstKey, "/") {
+			dstKey += path.Base(srcKey)
+		}
+
+		onItself := srcBucket == dstBucket && srcKey == dstKey
+		if onItself && len(opts.SetHeaders) == 0 {
+			return fmt.Errorf("'%s' would be copied onto itself", srcKey)
+		}
+
+		if err := copyObject(srcStorage, srcBucket, srcKey, dstStorage, dstKey, opts); err != nil {
+			return err
+		}
+
+		// moved onto itself only the headers changed, the copy is the object
+		if opts.Move && !onItself {
+			event := webhookEvent{Event: "delete", Bucket: srcBucket, Key: srcKey, Source: cliSource.Name}
+			if err := srcStorage.Delete(srcKey); err != nil {
+				event.Event = "error"
+				event.Error = err.Error()
+				s.notify(event)
+				return err
+			}
+			s.notify(event)
+		}
+
+		fmt.Printf("%s %s to s3://%s/%s\n", action, srcKey, dstBucket, dstKey)
+		return nil
+	}
+
+	// photos is the folder photos/, not photos-old/ too
+	srcKey = folderPrefix(srcKey)
+	dstKey = folderPrefix(dstKey)
+
+	srcS3pal := *s
+	srcS3pal.Config.Aws.Bucket = srcBucket
+	srcS3pal.Storage = srcStorage
+
+	listing, err := srcS3pal.listDetailed(srcKey, "", "", 0, false, 0)
+	if err != nil {
+		return err
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var copied []string
+	var moved []string
+	failed := 0
+	sem := make(chan bool, defaultCopyConcurrency)
+
+	for _, item := range listing.Items {
+		key := dstKey + item.Key[len(srcKey):]
+		if srcBucket == dstBucket && key == item.Key && len(opts.SetHeaders) == 0 {
+			continue
+		}
+
+		wg.Add(1)
+		sem <- true
+		go func(from string, to string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			err := copyObject(srcStorage, srcBucket, from, dstStorage, to, opts)
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			if err != nil {
+				fmt.Printf("Error copying %s: %v\n", from, err)
+				failed++
+				return
+			}
+
+			fmt.Printf("%s %s to s3://%s/%s\n", action, from, dstBucket, to)
+			copied = append(copied, from)
+			if srcBucket != dstBucket || from != to {
+				moved = append(moved, from)
+			}
+		}(item.Key, key)
+	}
+
+	wg.Wait()
+
+	if opts.Move && len(moved) > 0 {
+		// only what was copied, the rest stays where it is, and never a
+		// key that was copied onto itself
+		if _, err = srcS3pal.deleteKeys(moved, ioutil.Discard); err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("\n%v Objects %s, %v Failed\n", len(copied), strings.ToLower(action), failed)
+
+	if failed > 0 {
+		return fmt.Errorf("%d objects not copied", failed)
+	}
+
+	return nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestParseS3Path(t *testing.T) {
+	bucket, key := parseS3Path("s3://other/uploads/cat.jpg", "mybucket")
+	assert.Equal(t, "other", bucket)
+	assert.Equal(t, "uploads/cat.jpg", key)
+
+	bucket, key = parseS3Path("uploads/cat.jpg", "mybucket")
+	assert.Equal(t, "mybucket", bucket)
+	assert.Equal(t, "uploads/cat.jpg", key)
+}
+
+func TestCopyAndMove(t *testing.T) {
+	storage := newTempFilesystemStorage()
+	defer os.RemoveAll(storage.root)
+	putString(storage, "old/a.txt", "a")
+	putString(storage, "old/sub/b.txt", "b")
+	s3pal := getS3palWithStorage(storage)
+
+	headers, _ := parseHeaders([]string{"Cache-Control: max-age=10"})
+	err := s3pal.copyObjects("old/a.txt", "copies/", copyOptions{SetHeaders: headers})
+	assert.Nil(t, err)
+
+	info, err := storage.Head("copies/a.txt")
+	assert.Nil(t, err)
+	assert.Equal(t, "max-age=10", info.Headers.Get("Cache-Control"))
+	assert.Equal(t, "text/plain", info.ContentType)
+
+	acl, err := storage.GetACL("copies/a.txt")
+	assert.Nil(t, err)
+	assert.Equal(t, "public-read", string(acl))
+
+	err = s3pal.copyObjects("old/", "new/", copyOptions{Recursive: true, Move: true})
+	assert.Nil(t, err)
+
+	_, err = storage.Head("new/sub/b.txt")
+	assert.Nil(t, err)
+	_, err = storage.Head("old/sub/b.txt")
+	assert.NotNil(t, err)
+}
+
+func TestCopyKeepsACL(t *testing.T) {
+	storage := newMemStorage()
+	storage.Put("a.txt", strings.NewReader("a"), 1, http.Header{}, "private")
+	storage.Put("b.txt", strings.NewReader("b"), 1, http.Header{}, "private")
+	s3pal := getS3palWithStorage(storage)
+
+	err := s3pal.copyObjects("a.txt", "copies/", copyOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, "private", storage.objects["copies/a.txt"].acl)
+
+	err = s3pal.copyObjects("b.txt", "copies/", copyOptions{ACL: "public-read"})
+	assert.Nil(t, err)
+	assert.Equal(t, "public-read", storage.objects["copies/b.txt"].acl)
+}
+
+func TestCopyRecursivePrefixes(t *testing.T) {
+	storage := newMemStorage()
+	for _, key := range []string{"photos/a.jpg", "photos/sub/b.jpg", "photos-old/c.jpg"} {
+		storage.Put(key, strings.NewReader("x"), 1, http.Header{}, "private")
+	}
+	s3pal := getS3palWithStorage(storage)
+
+	err := s3pal.copyObjects("photos", "archive/", copyOptions{Recursive: true})
+	assert.Nil(t, err)
+
+	var keys []string
+	for key := range storage.objects {
+		if strings.HasPrefix(key, "archive") {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	assert.Equal(t, []string{"archive/a.jpg", "archive/sub/b.jpg"}, keys)
+
+	assert.Equal(t, "", folderPrefix(""))
+	assert.Equal(t, "", folderPrefix("/"))
+	assert.Equal(t, "photos/", folderPrefix("photos//"))
+}
+
+func TestMoveOntoItselfKeepsObject(t *testing.T) {
+	storage := newMemStorage()
+	storage.Put("a.txt", strings.NewReader("a"), 1, http.Header{}, "private")
+	storage.Put("docs/b.txt", strings.NewReader("b"), 1, http.Header{}, "private")
+	s3pal := getS3palWithStorage(storage)
+
+	headers, _ := parseHeaders([]string{"Cache-Control: max-age=10"})
+
+	err := s3pal.copyObjects("a.txt", "a.txt", copyOptions{Move: true, SetHeaders: headers})
+	assert.Nil(t, err)
+	if assert.NotNil(t, storage.objects["a.txt"]) {
+		assert.Equal(t, "max-age=10", storage.objects["a.txt"].headers.Get("Cache-Control"))
+	}
+
+	err = s3pal.copyObjects("docs/", "docs/", copyOptions{Move: true, Recursive: true, SetHeaders: headers})
+	assert.Nil(t, err)
+	if assert.NotNil(t, storage.objects["docs/b.txt"]) {
+		assert.Equal(t, "max-age=10", storage.objects["docs/b.txt"].headers.Get("Cache-Control"))
+	}
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+type awsCredentials struct {
+	AccessKey string
+	SecretKey string
+	Token     string
+	// where they came from, shown by s3pal info
+	Source string
+	// zero when they do not expire
+	Expires time.Time
+}
+
+// credentialProcessOutput is what a credential_process prints
+type credentialProcessOutput struct {
+	Version         int
+	AccessKeyId     string
+	SecretAccessKey string
+	SessionToken    string
+	Expiration      string
+}
+
+func awsConfigPath(envName string, name string) string {
+	if p := os.Getenv(envName); len(p) > 0 {
+		return p
+	}
+
+	usr, err := user.Current()
+	if err != nil {
+		return ""
+	}
+
+	return filepath.Join(usr.HomeDir, ".aws", name)
+}
+
+// readINI reads the sections of an AWS credentials or config file
+func readINI(file string) (map[string]map[string]string, error) {
+	fd, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	sections := map[string]map[string]string{}
+	var section map[string]string
+
+	scanner := bufio.NewScanner(fd)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+
+		if line[0] == '[' && line[len(line)-1] == ']' {
+			name := strings.TrimSpace(line[1 : len(line)-1])
+			section = sections[name]
+			if section == nil {
+				section = map[string]string{}
+				sections[name] = section
+			}
+			continue
+		}
+
+		i := strings.Index(line, "=")
+		if i < 0 || section == nil {
+			continue
+		}
+
+		section[strings.TrimSpace(line[:i])] = strings.TrimSpace(line[i+1:])
+	}
+
+	return sections, scanner.Err()
+}
+
+// awsProfile is the profile to use: aws.profile (or --profile), then
+// AWS_PROFILE, then default
+func awsProfile(config AwsConfig) string {
+	if len(config.Profile) > 0 {
+		return config.Profile
+	}
+
+	if profile := os.Getenv("AWS_PROFILE"); len(profile) > 0 {
+		return profile
+	}
+
+	return "default"
+}
+
+// profileSettings merges the profile's section of ~/.aws/config
+// ("[profile name]") with the one of ~/.aws/credentials ("[name]"), the
+// credentials file wins.
+func profileSettings(profile string) (map[string]string, string) {
+	settings := map[string]string{}
+	source := ""
+
+	configName := "profile " + profile
+	if profile == "default" {
+		configName = "default"
+	}
+
+	configFile := awsConfigPath("AWS_CONFIG_FILE", "config")
+	if sections, err := readINI(configFile); err == nil && sections[configName] != nil {
+		for k, v := range sections[configName] {
+			settings[k] = v
+		}
+		source = configFile
+	}
+
+	credentialsFile := awsConfigPath("AWS_SHARED_CREDENTIALS_FILE", "credentials")
+	if sections, err := readINI(credentialsFile); err == nil && sections[profile] != nil {
+		for k, v := range sections[profile] {
+			settings[k] = v
+		}
+		source = credentialsFile
+	}
+
+	return settings, source
+}
+
+// shellCommand runs command through the shell, so it can have arguments,
+// pipes and so on
+func shellCommand(command string) *exec.Cmd {
+	if runtime.GOOS == "windows" {
+		return exec.Command("cmd", "/C", command)
+	}
+
+	return exec.Command("sh", "-c", command)
+}
+
+// credential_process results by command, used until a minute before
+// they expire
+var processCredentials = struct {
+	creds map[string]awsCredentials
+	mu    sync.Mutex
+}{creds: map[string]awsCredentials{}}
+
+// runCredentialProcess runs command through the shell and reads the
+// credentials it prints (see the AWS credential_process docs).
+func runCredentialProcess(command string) (*awsCredentials, error) {
+	processCredentials.mu.Lock()
+	defer processCredentials.mu.Unlock()
+
+	if creds, ok := processCredentials.creds[command]; ok {
+		if creds.Expires.IsZero() || time.Now().Add(time.Minute).Before(creds.Expires) {
+			return &creds, nil
+		}
+	}
+
+	cmd := shellCommand(command)
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("credential_process '%s' failed: %v %s", command, err, strings.TrimSpace(stderr.String()))
+	}
+
+	var output credentialProcessOutput
+	if err = json.Unmarshal(out, &output); err != nil {
+		return nil, fmt.Errorf("credential_process '%s' printed invalid JSON: %v", command, err)
+	}
+
+	if output.Version != 1 {
+		return nil, fmt.Errorf("credential_process '%s' printed Version %d, only 1 is supported", command, output.Version)
+	}
+
+	if len(output.AccessKeyId) == 0 || len(output.SecretAccessKey) == 0 {
+		return nil, fmt.Errorf("credential_process '%s' printed no AccessKeyId or SecretAccessKey", command)
+	}
+
+	creds := &awsCredentials{
+		AccessKey: output.AccessKeyId,
+		SecretKey: output.SecretAccessKey,
+		Token:     output.SessionToken,
+		Source:    "credential_process",
+	}
+
+	if len(output.Expiration) > 0 {
+		expires, err := time.Parse(time.RFC3339, output.Expiration)
+		if err != nil {
+			return nil, fmt.Errorf("credential_process '%s' printed an invalid Expiration: %v", command, err)
+		}
+		creds.Expires = expires
+	}
+
+	processCredentials.creds[command] = *creds
+	return creds, nil
+}
+
+// resolveCredentials looks for credentials in this order:
+//
+//	access_key and secret_key in s3pal.toml
+//	AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN
+//	  (skipped when a profile is set with aws.profile or --profile)
+//	the profile in ~/.aws/credentials or ~/.aws/config, keys or its
+//	  credential_process
+//	credential_process in s3pal.toml
+func resolveCredentials(config AwsConfig) (*awsCredentials, error) {
+	if len(config.AccessKey) > 0 || len(config.SecretKey) > 0 {
+		if len(config.AccessKey) == 0 || len(config.SecretKey) == 0 {
+			return nil, fmt.Errorf("access_key and secret_key must both be set in s3pal.toml")
+		}
+
+		return &awsCredentials{AccessKey: config.AccessKey, SecretKey: config.SecretKey, Source: "s3pal.toml"}, nil
+	}
+
+	if len(config.Profile) == 0 {
+		accessKey := os.Getenv("AWS_ACCESS_KEY_ID")
+		secretKey := os.Getenv("AWS_SECRET_ACCESS_KEY")
+		if len(accessKey) > 0 && len(secretKey) > 0 {
+			return &awsCredentials{
+				AccessKey: accessKey,
+				SecretKey: secretKey,
+				Token:     os.Getenv("AWS_SESSION_TOKEN"),
+				Source:    "environment (AWS_ACCESS_KEY_ID)",
+			}, nil
+		}
+	}
+
+	profile := awsProfile(config)
+	settings, file := profileSettings(profile)
+
+	if accessKey := settings["aws_access_key_id"]; len(accessKey) > 0 {
+		if len(settings["aws_secret_access_key"]) == 0 {
+			return nil, fmt.Errorf("profile '%s' in %s has no aws_secret_access_key", profile, file)
+		}
+
+		return &awsCredentials{
+			AccessKey: accessKey,
+			SecretKey: settings["aws_secret_access_key"],
+			Token:     settings["aws_session_token"],
+			Source:    fmt.Sprintf("profile '%s' in %s", profile, file),
+		}, nil
+	}
+
+	if command := settings["credential_process"]; len(command) > 0 {
+		creds, err := runCredentialProcess(command)
+		if err != nil {
+			return nil, err
+		}
+
+		creds.Source = fmt.Sprintf("credential_process of profile '%s' in %s", profile, file)
+		return creds, nil
+	}
+
+	if len(config.Profile) > 0 && len(file) == 0 {
+		return nil, fmt.Errorf("profile '%s' not found in ~/.aws/credentials or ~/.aws/config", profile)
+	}
+
+	if len(config.CredentialProcess) > 0 {
+		creds, err := runCredentialProcess(config.CredentialProcess)
+		if err != nil {
+			return nil, err
+		}
+
+		creds.Source = "credential_process in s3pal.toml"
+		return creds, nil
+	}
+
+	return nil, fmt.Errorf("no AWS credentials found. Set access_key and secret_key in s3pal.toml, AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY, a profile in ~/.aws/credentials or credential_process")
+}
+
+// maskKey keeps the start and end of an access key so it can be told
+// apart without showing it
+func maskKey(key string) string {
+	if len(key) <= 8 {
+		return strings.Repeat("*", len(key))
+	}
+
+	return key[:4] + strings.Repeat("*", len(key)-8) + key[len(key)-4:]
+}
+
+// printInfo shows the effective settings, mainly where the credentials
+// come from
+func (s *S3pal) printInfo(w io.Writer, configFile string) {
+	config := s.Config.Aws
+
+	fmt.Fprintf(w, "Config file:   %s\n", configFile)
+	fmt.Fprintf(w, "Bucket:        %s\n", config.Bucket)
+
+	if s.Config.Storage.Type == "filesystem" {
+		fmt.Fprintf(w, "Storage:       filesystem (%s)\n", s.newFilesystemStorage(config.Bucket).root)
+		return
+	}
+
+	fmt.Fprintf(w, "Region:        %s\n", config.Region)
+	if len(config.Endpoint) > 0 {
+		fmt.Fprintf(w, "Endpoint:      %s\n", config.Endpoint)
+	}
+
+	creds, err := resolveCredentials(config)
+	if err != nil {
+		fmt.Fprintf(w, "Credentials:   none (%v)\n", err)
+		return
+	}
+
+	fmt.Fprintf(w, "Credentials:   %s\n", creds.Source)
+	fmt.Fprintf(w, "Access key:    %s\n", maskKey(creds.AccessKey))
+	if len(creds.Token) > 0 {
+		fmt.Fprintf(w, "Session token: yes\n")
+	}
+	if !creds.Expires.IsZero() {
+		fmt.Fprintf(w, "Expires:       %s\n", creds.Expires.Local().Format(time.RFC1123))
+	}
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sidecar files hold the headers of the object next to it
+const fsMetaSuffix = ".s3pal-meta.json"
+
+type fsMeta struct {
+	ETag    string      `json:"etag"`
+	ACL     string      `json:"acl"`
+	Headers http.Header `json:"headers"`
+}
+
+// filesystemStorage keeps objects under root for offline use. The
+// server serves them from /files so URLs point back to s3pal itself.
+type filesystemStorage struct {
+	root    string
+	baseURL string
+	// conditional writes check and write under it
+	mu sync.Mutex
+}
+
+func newFilesystemStorage(root string, baseURL string) *filesystemStorage {
+	return &filesystemStorage{
+		root:    root,
+		baseURL: strings.TrimRight(baseURL, "/"),
+	}
+}
+
+func (f *filesystemStorage) path(key string) (string, error) {
+	root, err := filepath.Abs(f.root)
+	if err != nil {
+		return "", err
+	}
+
+	p := filepath.Join(root, filepath.FromSlash(key))
+	if !strings.HasPrefix(p, root+string(filepath.Separator)) || strings.HasSuffix(p, fsMetaSuffix) {
+		return "", fmt.Errorf("Invalid key '%s'", key)
+	}
+
+	return p, nil
+}
+
+func (f *filesystemStorage) Put(key string, r io.Reader, size int64, headers http.Header, acl string) (string, error) {
+	p, err := f.path(key)
+	if err != nil {
+		return "", err
+	}
+
+	if len(headers.Get("If-Match")) > 0 || len(headers.Get("If-None-Match")) > 0 {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+
+		current, err := f.Head(key)
+		if err != nil && err != ErrNotFound {
+			return "", err
+		}
+
+		if err = checkPreconditions(headers, current); err != nil {
+			return "", err
+		}
+
+		stored := http.Header{}
+		for name, values := range headers {
+			stored[name] = values
+		}
+		for _, name := range conditionalHeaderNames {
+			stored.Del(name)
+		}
+		headers = stored
+	}
+
+	if err = os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return "", err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(p), ".s3pal_")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+
+	hash := md5.New()
+	_, err = io.Copy(tmp, io.TeeReader(r, hash))
+	tmp.Close()
+	if err != nil {
+		return "", err
+	}
+
+	// TempFile creates it 0600, others may serve or read the storage dir
+	if err = os.Chmod(tmp.Name(), 0644); err != nil {
+		return "", err
+	}
+
+	meta := fsMeta{
+		ETag:    `"` + hex.EncodeToString(hash.Sum(nil)) + `"`,
+		ACL:     acl,
+		Headers: headers,
+	}
+
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return "", err
+	}
+
+	if err = ioutil.WriteFile(p+fsMetaSuffix, data, 0644); err != nil {
+		return "", err
+	}
+
+	if err = os.Rename(tmp.Name(), p); err != nil {
+		return "", err
+	}
+
+	return meta.ETag, nil
+}
+
+func (f *filesystemStorage) Get(key string) (io.ReadCloser, error) {
+	p, err := f.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	fd, err := os.Open(p)
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+
+	return fd, err
+}
+
+func (f *filesystemStorage) List(prefix, delim, marker string, max int) (*ListResult, error) {
+	if max <= 0 {
+		max = 1000
+	}
+
+	var keys []string
+	err := filepath.Walk(f.root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+
+		if info.IsDir() || strings.HasSuffix(p, fsMetaSuffix) || strings.HasPrefix(info.Name(), ".s3pal_") {
+			return nil
+		}
+
+		rel, err := filepath.Rel(f.root, p)
+		if err != nil {
+			return err
+		}
+
+		key := filepath.ToSlash(rel)
+		if strings.HasPrefix(key, prefix) && key > marker {
+			keys = append(keys, key)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(keys)
+
+	result := &ListResult{}
+	lastPrefix := ""
+	count := 0
+	for _, key := range keys {
+		if count == max {
+			result.IsTruncated = true
+			break
+		}
+
+		if len(delim) > 0 {
+			if i := strings.Index(key[len(prefix):], delim); i >= 0 {
+				commonPrefix := key[:len(prefix)+i+len(delim)]
+				if commonPrefix != lastPrefix && commonPrefix > marker {
+					result.CommonPrefixes = append(result.CommonPrefixes, commonPrefix)
+					result.NextMarker = commonPrefix
+					lastPrefix = commonPrefix
+					count++
+				}
+				continue
+			}
+		}
+
+		info, err := f.Head(key)
+		if err != nil {
+			return nil, err
+		}
+
+		result.Objects = append(result.Objects, *info)
+		result.NextMarker = key
+		count++
+	}
+
+	if !result.IsTruncated {
+		result.NextMarker = ""
+	}
+
+	return result, nil
+}
+
+func (f *filesystemStorage) Delete(key string) error {
+	p, err := f.path(key)
+	if err != nil {
+		return err
+	}
+
+	os.Remove(p + fsMetaSuffix)
+	err = os.Remove(p)
+	if os.IsNotExist(err) {
+		// S3 does not complain about missing keys either
+		return nil
+	}
+
+	return err
+}
+
+func (f *filesystemStorage) readMeta(p string) *fsMeta {
+	meta := &fsMeta{}
+
+	data, err := ioutil.ReadFile(p + fsMetaSuffix)
+	if err == nil {
+		json.Unmarshal(data, meta)
+	}
+
+	if meta.Headers == nil {
+		meta.Headers = http.Header{}
+	}
+
+	return meta
+}
+
+// GetACL returns the canned ACL the object was stored with
+func (f *filesystemStorage) GetACL(key string) ([]byte, error) {
+	p, err := f.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = os.Stat(p); os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+
+	return []byte(f.readMeta(p).ACL), nil
+}
+
+func (f *filesystemStorage) PutACL(key string, acl []byte) error {
+	p, err := f.path(key)
+	if err != nil {
+		return err
+	}
+
+	if _, err = os.Stat(p); os.IsNotExist(err) {
+		return ErrNotFound
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	meta := f.readMeta(p)
+	meta.ACL = string(acl)
+
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(p+fsMetaSuffix, data, 0644)
+}
+
+func (f *filesystemStorage) Head(key string) (*ObjectInfo, error) {
+	p, err := f.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := os.Stat(p)
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	if fi.IsDir() {
+		return nil, fmt.Errorf("'%s' is not an object", key)
+	}
+
+	meta := f.readMeta(p)
+
+	return &ObjectInfo{
+		Key:          key,
+		Size:         fi.Size(),
+		LastModified: fi.ModTime().UTC(),
+		ETag:         meta.ETag,
+		StorageClass: "STANDARD",
+		ContentType:  meta.Headers.Get("Content-Type"),
+		Headers:      meta.Headers,
+	}, nil
+}
+
+// URL escapes each part of key, it may have spaces, # or ?
+func (f *filesystemStorage) URL(key string) string {
+	parts := strings.Split(key, "/")
+	for i, part := range parts {
+		parts[i] = url.PathEscape(part)
+	}
+
+	return f.baseURL + "/" + strings.Join(parts, "/")
+}
+
+// SignedURL is the plain URL as the server does not check signatures
+// for local files.
+func (f *filesystemStorage) SignedURL(key string, expires time.Time) string {
+	return f.URL(key)
+}
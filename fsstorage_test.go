@@ -0,0 +1,100 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func newTempFilesystemStorage() *filesystemStorage {
+	root, _ := ioutil.TempDir("", "s3pal_fs_")
+	return newFilesystemStorage(root, "http://localhost:8080/files/")
+}
+
+func putString(f *filesystemStorage, key string, content string) error {
+	headers := http.Header{"Content-Type": []string{"text/plain"}}
+	_, err := f.Put(key, strings.NewReader(content), int64(len(content)), headers, "public-read")
+	return err
+}
+
+func TestFilesystemPutGetHead(t *testing.T) {
+	f := newTempFilesystemStorage()
+	defer os.RemoveAll(f.root)
+
+	assert.Nil(t, putString(f, "uploads/cat.txt", "meow"))
+
+	rc, err := f.Get("uploads/cat.txt")
+	assert.Nil(t, err)
+	data, _ := ioutil.ReadAll(rc)
+	rc.Close()
+	assert.Equal(t, "meow", string(data))
+
+	info, err := f.Head("uploads/cat.txt")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(4), info.Size)
+	assert.Equal(t, "text/plain", info.ContentType)
+	assert.Equal(t, `"4a4be40c96ac6314e91d93f38043a634"`, info.ETag)
+
+	if runtime.GOOS != "windows" {
+		fi, _ := os.Stat(filepath.Join(f.root, "uploads", "cat.txt"))
+		assert.Equal(t, os.FileMode(0644), fi.Mode().Perm())
+	}
+
+	assert.Equal(t, "http://localhost:8080/files/uploads/cat.txt", f.URL("uploads/cat.txt"))
+	assert.Equal(t, "http://localhost:8080/files/my%20cats/%231%3F%25.txt", f.URL("my cats/#1?%.txt"))
+}
+
+func TestFilesystemList(t *testing.T) {
+	f := newTempFilesystemStorage()
+	defer os.RemoveAll(f.root)
+
+	putString(f, "a/1.txt", "1")
+	putString(f, "a/b/2.txt", "2")
+	putString(f, "c.txt", "3")
+
+	result, err := f.List("", "", "", 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(result.Objects))
+	assert.Equal(t, "a/1.txt", result.Objects[0].Key)
+
+	result, _ = f.List("a/", "/", "", 0)
+	assert.Equal(t, 1, len(result.Objects))
+	assert.Equal(t, []string{"a/b/"}, result.CommonPrefixes)
+
+	result, _ = f.List("", "", "", 2)
+	assert.True(t, result.IsTruncated)
+	assert.Equal(t, "a/b/2.txt", result.NextMarker)
+
+	result, _ = f.List("", "", "a/b/2.txt", 2)
+	assert.False(t, result.IsTruncated)
+	assert.Equal(t, "c.txt", result.Objects[0].Key)
+}
+
+func TestFilesystemRejectsEscapingKeys(t *testing.T) {
+	f := newTempFilesystemStorage()
+	defer os.RemoveAll(f.root)
+
+	assert.NotNil(t, putString(f, "../outside.txt", "nope"))
+	assert.NotNil(t, putString(f, "a/../../outside.txt", "nope"))
+}
+
+func TestFilesystemConditionalPut(t *testing.T) {
+	f := newTempFilesystemStorage()
+	defer os.RemoveAll(f.root)
+
+	putString(f, "a.txt", "a")
+	info, _ := f.Head("a.txt")
+
+	headers := http.Header{"If-Match": []string{`"nope"`}}
+	_, err := f.Put("a.txt", nil, 0, headers, "private")
+	assert.Equal(t, ErrPreconditionFailed, err)
+
+	headers = http.Header{"If-Match": []string{info.ETag}}
+	_, err = f.Put("b.txt", nil, 0, headers, "private")
+	assert.Equal(t, ErrPreconditionFailed, err)
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultGetConcurrency = 4
+
+func fileMD5(filePath string) (string, error) {
+	fd, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer fd.Close()
+
+	hash := md5.New()
+	if _, err = io.Copy(hash, fd); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// localMatches is true when the file at localPath already has the
+// object's content. Plain ETags are the MD5 of the object, multipart ones
+// ("<md5>-<parts>") are not, so for those the file only has to be the same
+// size and not older.
+func localMatches(localPath string, size int64, etag string, lastModified time.Time) bool {
+	fi, err := os.Stat(localPath)
+	if err != nil || fi.IsDir() || fi.Size() != size {
+		return false
+	}
+
+	etag = strings.Trim(etag, `"`)
+	if len(etag) == 0 || strings.Contains(etag, "-") {
+		return !fi.ModTime().Before(lastModified)
+	}
+
+	sum, err := fileMD5(localPath)
+	return err == nil && sum == etag
+}
+
+// localPathForKey maps a key (relative to what is being downloaded) to a
+// path under dir. Keys that would end up outside of dir are rejected.
+func localPathForKey(dir string, rel string) (string, error) {
+	if len(rel) == 0 || strings.HasPrefix(rel, "/") || strings.Contains(rel, "\\") {
+		return "", fmt.Errorf("unsafe key '%s'", rel)
+	}
+
+	for _, part := range strings.Split(rel, "/") {
+		if part == ".." {
+			return "", fmt.Errorf("unsafe key '%s'", rel)
+		}
+	}
+
+	return filepath.Join(dir, filepath.FromSlash(rel)), nil
+}
+
+// download writes the object to localPath through a temp file so an
+// interrupted download never looks complete. The file gets the object's
+// last modified time.
+func (s *S3pal) download(key string, localPath string, lastModified time.Time) error {
+	rc, err := s.getStorage().Get(key)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	dir := filepath.Dir(localPath)
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(dir, ".s3pal_get_")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = io.Copy(tmp, rc)
+	tmp.Close()
+	if err != nil {
+		return err
+	}
+
+	// TempFile creates it 0600, a download is a normal file
+	if err = os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+
+	if err = os.Rename(tmp.Name(), localPath); err != nil {
+		return err
+	}
+
+	if !lastModified.IsZero() {
+		os.Chtimes(localPath, lastModified, lastModified)
+	}
+
+	return nil
+}
+
+// getObject downloads a single key to dest ("-" for stdout). An empty dest
+// or a folder gets a file named like the key.
+func (s *S3pal) getObject(key string, dest string) error {
+	storage := s.getStorage()
+
+	if dest == "-" {
+		rc, err := storage.Get(key)
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+
+		_, err = io.Copy(os.Stdout, rc)
+		return err
+	}
+
+	if len(dest) == 0 {
+		dest = path.Base(key)
+	} else if fi, err := os.Stat(dest); err == nil && fi.IsDir() {
+		dest = filepath.Join(dest, path.Base(key))
+	}
+
+	info, err := storage.Head(key)
+	if err != nil {
+		return err
+	}
+
+	if localMatches(dest, info.Size, info.ETag, info.LastModified) {
+		fmt.Printf("Skipped %s (%s is up to date)\n", key, dest)
+		return nil
+	}
+
+	if err = s.download(key, dest, info.LastModified); err != nil {
+		return err
+	}
+
+	fmt.Printf("Downloaded %s to %s\n", key, dest)
+	return nil
+}
+
+// getRecursive downloads everything under prefix into dir, keeping the
+// rest of the key as folders, with at most concurrency downloads at once.
+func (s *S3pal) getRecursive(prefix string, dir string, concurrency int) error {
+	listing, err := s.listDetailed(prefix, "", "", 0, false, 0)
+	if err != nil {
+		return err
+	}
+
+	if concurrency <= 0 {
+		concurrency = defaultGetConcurrency
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	downloaded, skipped, failed := 0, 0, 0
+	sem := make(chan bool, concurrency)
+
+	for _, item := range listing.Items {
+		// folder placeholders made by the S3 console
+		if strings.HasSuffix(item.Key, "/") {
+			continue
+		}
+
+		rel := strings.TrimPrefix(item.Key[len(prefix):], "/")
+		if len(rel) == 0 {
+			rel = path.Base(item.Key)
+		}
+
+		localPath, err := localPathForKey(dir, rel)
+		if err != nil {
+			fmt.Printf("Skipped %s: %v\n", item.Key, err)
+			failed++
+			continue
+		}
+
+		if localMatches(localPath, item.Size, item.ETag, item.LastModified) {
+			skipped++
+			continue
+		}
+
+		wg.Add(1)
+		sem <- true
+		go func(item ListItem, localPath string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			err := s.download(item.Key, localPath, item.LastModified)
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			if err != nil {
+				fmt.Printf("Error downloading %s: %v\n", item.Key, err)
+				failed++
+			} else {
+				fmt.Printf("Downloaded %s\n", localPath)
+				downloaded++
+			}
+		}(item, localPath)
+	}
+
+	wg.Wait()
+
+	fmt.Printf("\n%v Downloaded, %v Up to date, %v Failed\n", downloaded, skipped, failed)
+
+	if failed > 0 {
+		return fmt.Errorf("%d objects not downloaded", failed)
+	}
+
+	return nil
+}
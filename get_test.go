@@ -0,0 +1,51 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestLocalPathForKey(t *testing.T) {
+	p, err := localPathForKey("/tmp/dl", "2015/03/cat.jpg")
+	assert.Nil(t, err)
+	assert.Equal(t, filepath.FromSlash("/tmp/dl/2015/03/cat.jpg"), p)
+
+	for _, key := range []string{"../cat.jpg", "a/../../cat.jpg", "/etc/passwd", ""} {
+		_, err = localPathForKey("/tmp/dl", key)
+		assert.NotNil(t, err, key)
+	}
+}
+
+func TestGetRecursive(t *testing.T) {
+	storage := newTempFilesystemStorage()
+	defer os.RemoveAll(storage.root)
+	putString(storage, "uploads/2015/a.txt", "a")
+	putString(storage, "uploads/2016/b.txt", "bb")
+	putString(storage, "other/c.txt", "c")
+
+	dir, _ := ioutil.TempDir("", "s3pal_get_")
+	defer os.RemoveAll(dir)
+
+	s3pal := getS3palWithStorage(storage)
+	assert.Nil(t, s3pal.getRecursive("uploads/", dir, 2))
+
+	data, _ := ioutil.ReadFile(filepath.Join(dir, "2016", "b.txt"))
+	assert.Equal(t, "bb", string(data))
+	if runtime.GOOS != "windows" {
+		fi, _ := os.Stat(filepath.Join(dir, "2016", "b.txt"))
+		assert.Equal(t, os.FileMode(0644), fi.Mode().Perm())
+	}
+	_, err := os.Stat(filepath.Join(dir, "c.txt"))
+	assert.True(t, os.IsNotExist(err))
+
+	info, _ := storage.Head("uploads/2015/a.txt")
+	local := filepath.Join(dir, "2015", "a.txt")
+	assert.True(t, localMatches(local, info.Size, info.ETag, info.LastModified))
+
+	ioutil.WriteFile(local, []byte("x"), 0644)
+	assert.False(t, localMatches(local, info.Size, info.ETag, info.LastModified))
+}
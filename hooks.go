@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultHookTimeout = 30
+
+// how long a killed hook has to exit
+const hookReapTimeout = 5 * time.Second
+
+// hookUpload is what hooks get about an upload, as JSON on stdin and as
+// S3PAL_* environment variables
+type hookUpload struct {
+	Hook        string `json:"hook"`
+	Path        string `json:"path"`
+	Key         string `json:"key"`
+	URL         string `json:"url"`
+	Bucket      string `json:"bucket"`
+	ContentType string `json:"content_type"`
+	Size        int64  `json:"size"`
+	// server, watch-folder or cli
+	Source string `json:"source"`
+}
+
+// hookOutput is what a pre_upload hook may print to upload something else
+type hookOutput struct {
+	Path        string `json:"path"`
+	ContentType string `json:"content_type"`
+}
+
+func (s *S3pal) newHookUpload(path string, contentType string, key string, source eventSource) (*hookUpload, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &hookUpload{
+		Path:        path,
+		Key:         key,
+		URL:         s.makeUrl(key),
+		Bucket:      s.Config.Aws.Bucket,
+		ContentType: contentType,
+		Size:        fi.Size(),
+		Source:      source.Name,
+	}, nil
+}
+
+func (u *hookUpload) env() []string {
+	return append(os.Environ(),
+		"S3PAL_HOOK="+u.Hook,
+		"S3PAL_PATH="+u.Path,
+		"S3PAL_KEY="+u.Key,
+		"S3PAL_URL="+u.URL,
+		"S3PAL_BUCKET="+u.Bucket,
+		"S3PAL_CONTENT_TYPE="+u.ContentType,
+		"S3PAL_SIZE="+strconv.FormatInt(u.Size, 10),
+		"S3PAL_SOURCE="+u.Source,
+	)
+}
+
+func (s *S3pal) hookTimeout() time.Duration {
+	timeout := s.Config.Hooks.Timeout
+	if timeout <= 0 {
+		timeout = defaultHookTimeout
+	}
+
+	return time.Duration(timeout) * time.Second
+}
+
+// runHook runs command with the upload on stdin and returns what it
+// printed. It is killed after the hook timeout.
+func (s *S3pal) runHook(command string, upload *hookUpload) ([]byte, error) {
+	input, err := json.Marshal(upload)
+	if err != nil {
+		return nil, err
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := shellCommand(command)
+	cmd.Env = upload.env()
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	startHookGroup(cmd)
+
+	if err = cmd.Start(); err != nil {
+		return nil, fmt.Errorf("%s hook '%s' did not start: %v", upload.Hook, command, err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	timeout := s.hookTimeout()
+	select {
+	case err = <-done:
+	case <-time.After(timeout):
+		killHook(cmd)
+
+		// reap it, unless something it started got away
+		select {
+		case <-done:
+		case <-time.After(hookReapTimeout):
+		}
+
+		return nil, fmt.Errorf("%s hook '%s' killed after %v", upload.Hook, command, timeout)
+	}
+
+	if err != nil {
+		reason := strings.TrimSpace(stderr.String())
+		if len(reason) == 0 {
+			reason = strings.TrimSpace(stdout.String())
+		}
+
+		if len(reason) > 0 {
+			err = fmt.Errorf("%v: %s", err, reason)
+		}
+
+		return nil, fmt.Errorf("%s hook '%s' failed: %v", upload.Hook, command, err)
+	}
+
+	return stdout.Bytes(), nil
+}
+
+// runPreUploadHook runs hooks.pre_upload. When it fails the upload is
+// rejected. When it prints a JSON object with a path (and content_type)
+// that file is uploaded instead, upload is changed to it.
+func (s *S3pal) runPreUploadHook(upload *hookUpload) error {
+	command := s.Config.Hooks.PreUpload
+	if len(command) == 0 {
+		return nil
+	}
+
+	upload.Hook = "pre_upload"
+	out, err := s.runHook(command, upload)
+	if err != nil {
+		log.Println(err)
+		return rejectUpload("%v", err)
+	}
+
+	out = bytes.TrimSpace(out)
+	if len(out) > 0 && out[0] == '{' {
+		var output hookOutput
+		if err = json.Unmarshal(out, &output); err != nil {
+			return fmt.Errorf("pre_upload hook '%s' printed invalid JSON: %v", command, err)
+		}
+
+		if len(output.Path) > 0 {
+			upload.Path = output.Path
+		}
+
+		if len(output.ContentType) > 0 {
+			upload.ContentType = output.ContentType
+		}
+	} else if len(out) > 0 {
+		log.Printf("pre_upload: %s\n", out)
+	}
+
+	// the hook may have changed the file in place too
+	fi, err := os.Stat(upload.Path)
+	if err != nil {
+		return fmt.Errorf("pre_upload hook '%s' left no file to upload: %v", command, err)
+	}
+	upload.Size = fi.Size()
+
+	return nil
+}
+
+// runPostUploadHook runs hooks.post_upload after a successful upload. The
+// file is uploaded already, so failures are only logged.
+func (s *S3pal) runPostUploadHook(upload *hookUpload) {
+	command := s.Config.Hooks.PostUpload
+	if len(command) == 0 {
+		return
+	}
+
+	upload.Hook = "post_upload"
+	out, err := s.runHook(command, upload)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	if out = bytes.TrimSpace(out); len(out) > 0 {
+		log.Printf("post_upload: %s\n", out)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func hookTestFile(t *testing.T, content string) (string, func()) {
+	if runtime.GOOS == "windows" {
+		t.Skip("hook tests use sh")
+	}
+
+	dir, _ := ioutil.TempDir("", "s3pal_hooks_")
+	file := filepath.Join(dir, "cat.txt")
+	ioutil.WriteFile(file, []byte(content), 0644)
+
+	return file, func() { os.RemoveAll(dir) }
+}
+
+func TestPreUploadHookVeto(t *testing.T) {
+	file, cleanup := hookTestFile(t, "hello")
+	defer cleanup()
+
+	storage := newMemStorage()
+	s3pal := getS3palWithStorage(storage)
+	s3pal.Config.Hooks.PreUpload = `test "$S3PAL_KEY" != "secret/cat.txt" || { echo no secrets >&2; exit 1; }`
+
+	err := s3pal.uploadToS3(file, "text/plain", "secret/cat.txt", cliSource)
+	_, rejected := err.(*uploadRejectedError)
+	assert.True(t, rejected)
+	assert.Contains(t, err.Error(), "no secrets")
+	assert.Nil(t, storage.objects["secret/cat.txt"])
+
+	assert.Nil(t, s3pal.uploadToS3(file, "text/plain", "public/cat.txt", cliSource))
+	assert.NotNil(t, storage.objects["public/cat.txt"])
+}
+
+func TestPreUploadHookReplacesFile(t *testing.T) {
+	file, cleanup := hookTestFile(t, "hello")
+	defer cleanup()
+
+	storage := newMemStorage()
+	s3pal := getS3palWithStorage(storage)
+	s3pal.Config.Hooks.PreUpload = `tr a-z A-Z < "$S3PAL_PATH" > "$S3PAL_PATH.up" && echo "{\"path\": \"$S3PAL_PATH.up\", \"content_type\": \"text/x-shout\"}"`
+
+	assert.Nil(t, s3pal.uploadToS3(file, "text/plain", "cat.txt", cliSource))
+	obj := storage.objects["cat.txt"]
+	assert.Equal(t, "HELLO", string(obj.data))
+	assert.Equal(t, "text/x-shout", obj.headers.Get("Content-Type"))
+}
+
+func TestPostUploadHook(t *testing.T) {
+	file, cleanup := hookTestFile(t, "hello")
+	defer cleanup()
+
+	out := file + ".json"
+	s3pal := getS3palWithStorage(newMemStorage())
+	s3pal.Config.Aws.Bucket = "mybucket"
+	s3pal.Config.Hooks.PostUpload = `cat > "` + out + `"`
+
+	assert.Nil(t, s3pal.uploadToS3(file, "text/plain", "cat.txt", cliSource))
+
+	data, err := ioutil.ReadFile(out)
+	assert.Nil(t, err)
+
+	var upload hookUpload
+	assert.Nil(t, json.Unmarshal(data, &upload))
+	assert.Equal(t, hookUpload{
+		Hook:        "post_upload",
+		Path:        file,
+		Key:         "cat.txt",
+		URL:         s3pal.makeUrl("cat.txt"),
+		Bucket:      "mybucket",
+		ContentType: "text/plain",
+		Size:        5,
+		Source:      "cli",
+	}, upload)
+
+	// a failing post_upload hook does not fail the upload
+	s3pal.Config.Hooks.PostUpload = "exit 3"
+	assert.Nil(t, s3pal.uploadToS3(file, "text/plain", "cat.txt", cliSource))
+}
+
+func TestHookTimeout(t *testing.T) {
+	file, cleanup := hookTestFile(t, "hello")
+	defer cleanup()
+
+	storage := newMemStorage()
+	s3pal := getS3palWithStorage(storage)
+	s3pal.Config.Hooks.PreUpload = "sleep 5"
+	s3pal.Config.Hooks.Timeout = 1
+
+	err := s3pal.uploadToS3(file, "text/plain", "cat.txt", cliSource)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "killed")
+	assert.Nil(t, storage.objects["cat.txt"])
+}
+
+func TestSyncRunsHooks(t *testing.T) {
+	file, cleanup := hookTestFile(t, "hello")
+	defer cleanup()
+	dir := filepath.Dir(file)
+	ioutil.WriteFile(filepath.Join(dir, "secret.txt"), []byte("psst"), 0644)
+
+	storage := newMemStorage()
+	s3pal := getS3palWithStorage(storage)
+	s3pal.Config.Hooks.PreUpload = `test "$S3PAL_KEY" != "site/secret.txt" || { echo no secrets >&2; exit 1; }`
+	s3pal.Config.Hooks.PostUpload = `echo "$S3PAL_SOURCE" > "$S3PAL_PATH.done"`
+
+	summary, err := s3pal.syncUp(dir, "site", syncOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, summary.Transferred)
+	assert.Equal(t, 1, summary.Skipped)
+	assert.Equal(t, 0, summary.Failed)
+	assert.NotNil(t, storage.objects["site/cat.txt"])
+	assert.Nil(t, storage.objects["site/secret.txt"])
+
+	data, _ := ioutil.ReadFile(file + ".done")
+	assert.Equal(t, "cli\n", string(data))
+}
@@ -0,0 +1,21 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// startHookGroup makes the hook the leader of a new process group, so
+// killHook reaches the commands it started too
+func startHookGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// killHook kills the hook's process group. Its children would otherwise
+// keep running and keep its stdout open.
+func killHook(cmd *exec.Cmd) {
+	syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
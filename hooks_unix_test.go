@@ -0,0 +1,27 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestHookTimeoutKillsChildren(t *testing.T) {
+	file, cleanup := hookTestFile(t, "hello")
+	defer cleanup()
+
+	s3pal := getS3palWithStorage(newMemStorage())
+	// sh forks sleep, which keeps the hook's stdout open
+	s3pal.Config.Hooks.PreUpload = "sleep 30; true"
+	s3pal.Config.Hooks.Timeout = 1
+
+	start := time.Now()
+	err := s3pal.uploadToS3(file, "text/plain", "cat.txt", cliSource)
+	assert.Contains(t, err.Error(), "killed")
+
+	// the hook was reaped right away, it did not wait for hookReapTimeout
+	assert.True(t, time.Since(start) < time.Second+hookReapTimeout/2, time.Since(start).String())
+}
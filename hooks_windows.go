@@ -0,0 +1,16 @@
+package main
+
+import (
+	"os/exec"
+	"strconv"
+)
+
+func startHookGroup(cmd *exec.Cmd) {
+}
+
+// killHook kills the hook and the commands it started
+func killHook(cmd *exec.Cmd) {
+	if exec.Command("taskkill", "/T", "/F", "/PID", strconv.Itoa(cmd.Process.Pid)).Run() != nil {
+		cmd.Process.Kill()
+	}
+}
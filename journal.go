@@ -0,0 +1,174 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// journalEntry is an in-progress multipart upload of a local file. It is
+// only resumed for the same file (path, size and mtime) and bucket.
+type journalEntry struct {
+	Path     string             `json:"path"`
+	Size     int64              `json:"size"`
+	ModTime  time.Time          `json:"mtime"`
+	Bucket   string             `json:"bucket"`
+	Key      string             `json:"key"`
+	UploadID string             `json:"upload_id"`
+	PartSize int64              `json:"part_size"`
+	Parts    map[int]UploadPart `json:"parts"`
+
+	file string
+	mu   sync.Mutex
+}
+
+// multipartJournal keeps one file per upload so separate s3pal processes
+// (watch-folder and upload for instance) do not overwrite each other.
+type multipartJournal struct {
+	dir string
+}
+
+func (s *S3pal) getJournal() *multipartJournal {
+	dir := s.Config.Aws.MultipartJournal
+	if len(dir) == 0 {
+		usr, err := user.Current()
+		if err == nil {
+			dir = path.Join(usr.HomeDir, ".s3pal", "multipart")
+		} else {
+			dir = path.Join(os.TempDir(), "s3pal_multipart")
+		}
+	}
+
+	return &multipartJournal{dir: dir}
+}
+
+func journalFileName(bucket string, filePath string, size int64, modTime time.Time) string {
+	hash := sha1.New()
+	fmt.Fprintf(hash, "%s\n%s\n%d\n%d", bucket, filePath, size, modTime.UnixNano())
+	return hex.EncodeToString(hash.Sum(nil)) + ".json"
+}
+
+// find returns the entry for the file or nil if it has none
+func (j *multipartJournal) find(bucket string, filePath string) *journalEntry {
+	abs, err := filepath.Abs(filePath)
+	if err != nil {
+		return nil
+	}
+
+	fi, err := os.Stat(abs)
+	if err != nil {
+		return nil
+	}
+
+	file := filepath.Join(j.dir, journalFileName(bucket, abs, fi.Size(), fi.ModTime()))
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil
+	}
+
+	entry := &journalEntry{}
+	if err = json.Unmarshal(data, entry); err != nil {
+		return nil
+	}
+
+	entry.file = file
+	if entry.Parts == nil {
+		entry.Parts = map[int]UploadPart{}
+	}
+
+	return entry
+}
+
+func (j *multipartJournal) create(bucket string, filePath string, key string, uploadID string, partSize int64) (*journalEntry, error) {
+	abs, err := filepath.Abs(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := os.Stat(abs)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = os.MkdirAll(j.dir, 0700); err != nil {
+		return nil, err
+	}
+
+	entry := &journalEntry{
+		Path:     abs,
+		Size:     fi.Size(),
+		ModTime:  fi.ModTime(),
+		Bucket:   bucket,
+		Key:      key,
+		UploadID: uploadID,
+		PartSize: partSize,
+		Parts:    map[int]UploadPart{},
+		file:     filepath.Join(j.dir, journalFileName(bucket, abs, fi.Size(), fi.ModTime())),
+	}
+
+	return entry, entry.save()
+}
+
+// entries returns every upload in the journal, for any file
+func (j *multipartJournal) entries() []*journalEntry {
+	var result []*journalEntry
+
+	files, _ := filepath.Glob(filepath.Join(j.dir, "*.json"))
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			continue
+		}
+
+		entry := &journalEntry{}
+		if json.Unmarshal(data, entry) == nil {
+			entry.file = file
+			result = append(result, entry)
+		}
+	}
+
+	return result
+}
+
+func (e *journalEntry) save() error {
+	if len(e.file) == 0 {
+		return nil
+	}
+
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	tmp := e.file + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, e.file)
+}
+
+// addPart records a finished part. Parts finish concurrently.
+func (e *journalEntry) addPart(part UploadPart) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.Parts[part.N] = part
+	if err := e.save(); err != nil {
+		fmt.Printf("Could not update upload journal: %v\n", err)
+	}
+}
+
+func (e *journalEntry) remove() {
+	if len(e.file) > 0 {
+		os.Remove(e.file)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+const defaultKvPrefix = "kv/"
+
+var ErrInvalidKey = errors.New("invalid key")
+
+func (s *S3pal) kvPrefix() string {
+	prefix := s.Config.Aws.KvPrefix
+	if len(prefix) == 0 {
+		prefix = defaultKvPrefix
+	}
+
+	return prefix
+}
+
+// kvKey is the object key of a kv key. Keys may use / to group values but
+// can not have empty, . or .. parts.
+func (s *S3pal) kvKey(key string) (string, error) {
+	for _, part := range strings.Split(key, "/") {
+		if part == ".." || part == "." || len(part) == 0 {
+			return "", ErrInvalidKey
+		}
+	}
+
+	return s.kvPrefix() + key, nil
+}
+
+// kvContentType is application/json for values that parse as JSON
+func kvContentType(value []byte) string {
+	var v interface{}
+	if json.Unmarshal(value, &v) == nil {
+		return "application/json"
+	}
+
+	return "application/octet-stream"
+}
+
+// kvGet returns the value of key and its object, which has the ETag to
+// pass to kvSet and kvDelete.
+func (s *S3pal) kvGet(key string) ([]byte, *ObjectInfo, error) {
+	objectKey, err := s.kvKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	storage := s.getStorage()
+
+	info, err := storage.Head(objectKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rc, err := storage.Get(objectKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rc.Close()
+
+	value, err := ioutil.ReadAll(rc)
+	return value, info, err
+}
+
+// kvSet stores value under key and returns the ETag of that write. conditions may
+// have If-Match (the ETag the value must still have) or If-None-Match: *
+// (the key must not exist yet). They are checked here first and then sent
+// with the write, so backends that support conditional writes (S3, the
+// filesystem storage) can not lose a race. Values are always private.
+func (s *S3pal) kvSet(key string, value []byte, contentType string, conditions http.Header) (string, error) {
+	objectKey, err := s.kvKey(key)
+	if err != nil {
+		return "", err
+	}
+
+	storage := s.getStorage()
+
+	headers := http.Header{}
+	for _, name := range conditionalHeaderNames {
+		if v := conditions.Get(name); len(v) > 0 {
+			headers.Set(name, v)
+		}
+	}
+
+	if len(headers) > 0 {
+		current, err := storage.Head(objectKey)
+		if err != nil && err != ErrNotFound {
+			return "", err
+		}
+
+		if err = checkPreconditions(headers, current); err != nil {
+			return "", err
+		}
+	}
+
+	if len(contentType) == 0 {
+		contentType = kvContentType(value)
+	}
+	headers.Set("Content-Type", contentType)
+
+	return storage.Put(objectKey, bytes.NewReader(value), int64(len(value)), headers, "private")
+}
+
+// kvDelete removes key. With ifMatch it is not removed when it has another
+// ETag. That is a best-effort check right before an unconditional delete
+// (S3 has no conditional delete), a write in between is lost.
+func (s *S3pal) kvDelete(key string, ifMatch string) error {
+	objectKey, err := s.kvKey(key)
+	if err != nil {
+		return err
+	}
+
+	storage := s.getStorage()
+
+	if len(ifMatch) > 0 {
+		current, err := storage.Head(objectKey)
+		if err != nil && err != ErrNotFound {
+			return err
+		}
+
+		if err = checkPreconditions(http.Header{"If-Match": []string{ifMatch}}, current); err != nil {
+			return err
+		}
+	}
+
+	return storage.Delete(objectKey)
+}
+
+// kvList returns the keys starting with prefix
+func (s *S3pal) kvList(prefix string) ([]string, error) {
+	kvPrefix := s.kvPrefix()
+
+	listing, err := s.listDetailed(kvPrefix+prefix, "", "", 0, false, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := []string{}
+	for _, item := range listing.Items {
+		keys = append(keys, item.Key[len(kvPrefix):])
+	}
+
+	return keys, nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"os"
+	"testing"
+)
+
+func TestKvKey(t *testing.T) {
+	s3pal := getS3palWithStorage(newMemStorage())
+
+	key, err := s3pal.kvKey("app/settings")
+	assert.Nil(t, err)
+	assert.Equal(t, "kv/app/settings", key)
+
+	s3pal.Config.Aws.KvPrefix = "config/"
+	key, _ = s3pal.kvKey("flags")
+	assert.Equal(t, "config/flags", key)
+
+	for _, bad := range []string{"", "/abs", "dir/", "a//b", "../up", "a/./b"} {
+		_, err = s3pal.kvKey(bad)
+		assert.Equal(t, ErrInvalidKey, err, bad)
+	}
+}
+
+func TestKvSetGetDelete(t *testing.T) {
+	storage := newTempFilesystemStorage()
+	defer os.RemoveAll(storage.root)
+	s3pal := getS3palWithStorage(storage)
+
+	etag, err := s3pal.kvSet("app/settings", []byte(`{"debug":true}`), "", nil)
+	assert.Nil(t, err)
+	assert.NotEqual(t, "", etag)
+
+	s3pal.kvSet("app/name", []byte("s3pal"), "", nil)
+
+	value, info, err := s3pal.kvGet("app/settings")
+	assert.Nil(t, err)
+	assert.Equal(t, `{"debug":true}`, string(value))
+	assert.Equal(t, etag, info.ETag)
+	assert.Equal(t, "application/json", info.ContentType)
+
+	_, info, _ = s3pal.kvGet("app/name")
+	assert.Equal(t, "application/octet-stream", info.ContentType)
+
+	keys, err := s3pal.kvList("app/")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"app/name", "app/settings"}, keys)
+
+	assert.Nil(t, s3pal.kvDelete("app/name", ""))
+	_, _, err = s3pal.kvGet("app/name")
+	assert.Equal(t, ErrNotFound, err)
+}
+
+func TestKvConditionalWrites(t *testing.T) {
+	storage := newTempFilesystemStorage()
+	defer os.RemoveAll(storage.root)
+	s3pal := getS3palWithStorage(storage)
+
+	create := http.Header{"If-None-Match": []string{"*"}}
+	etag, err := s3pal.kvSet("counter", []byte("1"), "", create)
+	assert.Nil(t, err)
+
+	_, err = s3pal.kvSet("counter", []byte("1"), "", create)
+	assert.Equal(t, ErrPreconditionFailed, err)
+
+	// two writers read the same version, only the first one wins
+	match := http.Header{"If-Match": []string{etag}}
+	newETag, err := s3pal.kvSet("counter", []byte("2"), "", match)
+	assert.Nil(t, err)
+
+	_, err = s3pal.kvSet("counter", []byte("3"), "", match)
+	assert.Equal(t, ErrPreconditionFailed, err)
+
+	value, _, _ := s3pal.kvGet("counter")
+	assert.Equal(t, "2", string(value))
+
+	// conditions are not stored with the value
+	info, _ := storage.Head("kv/counter")
+	assert.Equal(t, "", info.Headers.Get("If-Match"))
+
+	assert.Equal(t, ErrPreconditionFailed, s3pal.kvDelete("counter", etag))
+	assert.Nil(t, s3pal.kvDelete("counter", newETag))
+}
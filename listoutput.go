@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+const listTimeFormat = "2006-01-02 15:04:05"
+
+// printListLong prints one object per line like `ls -l`: last modified,
+// size, storage class and the key (or URL). Folders come first.
+func printListLong(w io.Writer, listing *Listing, urls bool) {
+	for _, prefix := range listing.Prefixes {
+		fmt.Fprintf(w, "%19s %12s %-12s %s\n", "", "DIR", "", prefix)
+	}
+
+	for _, item := range listing.Items {
+		name := item.Key
+		if urls {
+			name = item.URL
+		}
+
+		fmt.Fprintf(w, "%s %12d %-12s %s\n", item.LastModified.UTC().Format(listTimeFormat), item.Size, item.StorageClass, name)
+	}
+}
+
+// printListJSON prints the items, or an object with prefixes and items
+// when the listing has folders.
+func printListJSON(w io.Writer, listing *Listing, dirs bool) error {
+	items := listing.Items
+	if items == nil {
+		items = []ListItem{}
+	}
+
+	var out interface{} = items
+	if dirs {
+		prefixes := listing.Prefixes
+		if prefixes == nil {
+			prefixes = []string{}
+		}
+
+		out = map[string]interface{}{
+			"prefixes": prefixes,
+			"items":    items,
+		}
+	}
+
+	data, err := json.MarshalIndent(out, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(w, "%s\n", data)
+	return err
+}
+
+// printListCSV prints a row per object. Folders only have their key.
+func printListCSV(w io.Writer, listing *Listing) error {
+	out := csv.NewWriter(w)
+	out.Write([]string{"key", "size", "last_modified", "etag", "storage_class", "url"})
+
+	for _, prefix := range listing.Prefixes {
+		out.Write([]string{prefix, "", "", "", "", ""})
+	}
+
+	for _, item := range listing.Items {
+		out.Write([]string{
+			item.Key,
+			strconv.FormatInt(item.Size, 10),
+			item.LastModified.UTC().Format(time.RFC3339),
+			item.ETag,
+			item.StorageClass,
+			item.URL,
+		})
+	}
+
+	out.Flush()
+	return out.Error()
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testListing() *Listing {
+	modified := time.Date(2015, 6, 1, 12, 30, 0, 0, time.UTC)
+
+	return &Listing{
+		Prefixes: []string{"photos/"},
+		Items: []ListItem{
+			{Key: "cat.jpg", Size: 1024, LastModified: modified, ETag: "abc", StorageClass: "STANDARD", URL: "https://b.s3.amazonaws.com/cat.jpg"},
+			{Key: `my "best", cat.jpg`, Size: 7, LastModified: modified, ETag: "def", StorageClass: "GLACIER", URL: "https://b.s3.amazonaws.com/my%20best.jpg"},
+		},
+	}
+}
+
+func TestPrintListLong(t *testing.T) {
+	tests := []struct {
+		urls  bool
+		lines []string
+	}{
+		{false, []string{
+			"                             DIR              photos/",
+			"2015-06-01 12:30:00         1024 STANDARD     cat.jpg",
+			`2015-06-01 12:30:00            7 GLACIER      my "best", cat.jpg`,
+		}},
+		{true, []string{
+			"                             DIR              photos/",
+			"2015-06-01 12:30:00         1024 STANDARD     https://b.s3.amazonaws.com/cat.jpg",
+			"2015-06-01 12:30:00            7 GLACIER      https://b.s3.amazonaws.com/my%20best.jpg",
+		}},
+	}
+
+	for _, test := range tests {
+		var out bytes.Buffer
+		printListLong(&out, testListing(), test.urls)
+		assert.Equal(t, strings.Join(test.lines, "\n")+"\n", out.String())
+	}
+}
+
+func TestPrintListJSON(t *testing.T) {
+	tests := []struct {
+		listing *Listing
+		dirs    bool
+		want    string
+	}{
+		{&Listing{}, false, "[]\n"},
+		{&Listing{}, true, "{\n  \"items\": [],\n  \"prefixes\": []\n}\n"},
+	}
+
+	for _, test := range tests {
+		var out bytes.Buffer
+		assert.Nil(t, printListJSON(&out, test.listing, test.dirs))
+		assert.Equal(t, test.want, out.String())
+	}
+
+	var out bytes.Buffer
+	assert.Nil(t, printListJSON(&out, testListing(), true))
+
+	var parsed struct {
+		Prefixes []string                 `json:"prefixes"`
+		Items    []map[string]interface{} `json:"items"`
+	}
+	assert.Nil(t, json.Unmarshal(out.Bytes(), &parsed))
+	assert.Equal(t, []string{"photos/"}, parsed.Prefixes)
+	assert.Equal(t, 2, len(parsed.Items))
+	assert.Equal(t, map[string]interface{}{
+		"key":           "cat.jpg",
+		"size":          float64(1024),
+		"last_modified": "2015-06-01T12:30:00Z",
+		"etag":          "abc",
+		"storage_class": "STANDARD",
+		"url":           "https://b.s3.amazonaws.com/cat.jpg",
+	}, parsed.Items[0])
+}
+
+func TestPrintListCSV(t *testing.T) {
+	var out bytes.Buffer
+	assert.Nil(t, printListCSV(&out, testListing()))
+
+	lines := strings.Split(out.String(), "\n")
+	assert.Equal(t, "key,size,last_modified,etag,storage_class,url", lines[0])
+	assert.Equal(t, "photos/,,,,,", lines[1])
+	assert.Equal(t, `"my ""best"", cat.jpg",7,2015-06-01T12:30:00Z,def,GLACIER,https://b.s3.amazonaws.com/my%20best.jpg`, lines[3])
+
+	rows, err := csv.NewReader(&out).ReadAll()
+	assert.Nil(t, err)
+	assert.Equal(t, 4, len(rows))
+	assert.Equal(t, []string{"cat.jpg", "1024", "2015-06-01T12:30:00Z", "abc", "STANDARD", "https://b.s3.amazonaws.com/cat.jpg"}, rows[2])
+	assert.Equal(t, `my "best", cat.jpg`, rows[3][0])
+}
+
+func TestListHandlerDetail(t *testing.T) {
+	storage := newMemStorage()
+	storage.objects["uploads/cat.jpg"] = &memObject{data: []byte("meow"), headers: http.Header{}}
+	storage.objects["uploads/dog.jpg"] = &memObject{data: []byte("woof!"), headers: http.Header{}}
+	storage.objects["other/fish.jpg"] = &memObject{data: []byte("blub"), headers: http.Header{}}
+	s3pal := getS3palWithStorage(storage)
+
+	gin.SetMode(gin.ReleaseMode)
+	r := gin.New()
+	r.GET("/list", s3pal.listHandler(&ListCache{}))
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/list?prefix=uploads/&detail=true", nil)
+	r.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+
+	var items []map[string]interface{}
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &items))
+	if assert.Equal(t, 2, len(items)) {
+		assert.Equal(t, "uploads/cat.jpg", items[0]["key"])
+		assert.Equal(t, float64(4), items[0]["size"])
+		assert.Equal(t, "mem://uploads/cat.jpg", items[0]["url"])
+		for _, field := range []string{"last_modified", "etag", "storage_class"} {
+			_, ok := items[0][field]
+			assert.True(t, ok, field)
+		}
+	}
+
+	// paged, an object with a cursor
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/list?prefix=uploads/&detail=true&limit=1", nil)
+	r.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+
+	var page struct {
+		Items      []ListItem `json:"items"`
+		NextCursor string     `json:"next_cursor"`
+	}
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &page))
+	assert.Equal(t, 1, len(page.Items))
+	assert.Equal(t, "uploads/cat.jpg", page.Items[0].Key)
+	assert.NotEmpty(t, page.NextCursor)
+
+	// plain, the keys
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/list?prefix=uploads/", nil)
+	r.ServeHTTP(w, req)
+	assert.Equal(t, `["uploads/cat.jpg","uploads/dog.jpg"]`, strings.TrimSpace(w.Body.String()))
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const defaultModifyConcurrency = 8
+
+type modifyOptions struct {
+	Prefix        string
+	Match         string
+	AddHeaders    http.Header
+	RemoveHeaders []string
+	// empty keeps each object's ACL, S3 resets it on every copy
+	ACL         string
+	DryRun      bool
+	Concurrency int
+	// keys already modified, one per line, so a run can be resumed
+	ProgressLog string
+}
+
+// modifiedHeaders is the metadata of an object after adding and removing
+// headers
+func (o modifyOptions) modifiedHeaders(current http.Header) http.Header {
+	headers := objectHeaders(current)
+
+	for _, name := range o.RemoveHeaders {
+		headers.Del(name)
+	}
+
+	for name, values := range o.AddHeaders {
+		headers[http.CanonicalHeaderKey(name)] = values
+	}
+
+	return headers
+}
+
+// defaultProgressLog is the same file for the same modify command
+func (s *S3pal) defaultProgressLog(opts modifyOptions) string {
+	hash := sha1.New()
+	fmt.Fprintf(hash, "%s\n%s\n%s\n%s\n%v\n%s", s.Config.Aws.Bucket, opts.Prefix, opts.Match, formatHeaders(opts.AddHeaders), opts.RemoveHeaders, opts.ACL)
+	name := hex.EncodeToString(hash.Sum(nil))[:16] + ".log"
+
+	dir := os.TempDir()
+	if usr, err := user.Current(); err == nil {
+		dir = filepath.Join(usr.HomeDir, ".s3pal")
+	}
+
+	return filepath.Join(dir, "modify", name)
+}
+
+func readProgressLog(file string) map[string]bool {
+	done := map[string]bool{}
+
+	fd, err := os.Open(file)
+	if err != nil {
+		return done
+	}
+	defer fd.Close()
+
+	scanner := bufio.NewScanner(fd)
+	for scanner.Scan() {
+		if line := scanner.Text(); len(line) > 0 {
+			done[line] = true
+		}
+	}
+
+	return done
+}
+
+// modifyObjects rewrites the headers and ACL of every object under the
+// prefix by copying each one onto itself. Keys are appended to the
+// progress log as they are done and skipped when the same command runs
+// again. The log is removed once everything is modified.
+func (s *S3pal) modifyObjects(opts modifyOptions) error {
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = defaultModifyConcurrency
+	}
+
+	if len(opts.ProgressLog) == 0 {
+		opts.ProgressLog = s.defaultProgressLog(opts)
+	}
+
+	listing, err := s.listDetailed(opts.Prefix, "", "", 0, false, 0)
+	if err != nil {
+		return err
+	}
+
+	done := readProgressLog(opts.ProgressLog)
+	if len(done) > 0 {
+		fmt.Printf("Resuming, %v objects already modified (%s)\n", len(done), opts.ProgressLog)
+	}
+
+	var keys []string
+	for _, item := range listing.Items {
+		if done[item.Key] || (len(opts.Match) > 0 && !matchKey(opts.Match, item.Key)) {
+			continue
+		}
+		keys = append(keys, item.Key)
+	}
+	sort.Strings(keys)
+
+	storage := s.getStorage()
+
+	if opts.DryRun {
+		for _, key := range keys {
+			info, err := storage.Head(key)
+			if err != nil {
+				fmt.Printf("Error reading %s: %v\n", key, err)
+				continue
+			}
+
+			fmt.Printf("Would modify %s: %s (ACL %s)\n", key, formatHeaders(opts.modifiedHeaders(info.Headers)), modifiedACL(storage, key, opts.ACL))
+		}
+		fmt.Printf("\n%v Objects would be modified\n", len(keys))
+		return nil
+	}
+
+	if err = os.MkdirAll(filepath.Dir(opts.ProgressLog), 0700); err != nil {
+		return err
+	}
+
+	progress, err := os.OpenFile(opts.ProgressLog, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer progress.Close()
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	modified, failed := 0, 0
+	sem := make(chan bool, opts.Concurrency)
+
+	for _, key := range keys {
+		wg.Add(1)
+		sem <- true
+		go func(key string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			info, err := storage.Head(key)
+			if err == nil {
+				headers := opts.modifiedHeaders(info.Headers)
+				err = copyACL(storage, s.Config.Aws.Bucket, key, storage, key, headers, opts.ACL)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			if err != nil {
+				fmt.Printf("Error modifying %s: %v\n", key, err)
+				failed++
+				return
+			}
+
+			fmt.Fprintln(progress, key)
+			fmt.Printf("Modified %s\n", key)
+			modified++
+		}(key)
+	}
+
+	wg.Wait()
+
+	fmt.Printf("\n%v Objects modified, %v Failed\n", modified, failed)
+
+	if failed > 0 {
+		return fmt.Errorf("%d objects not modified, run the same command again to retry them", failed)
+	}
+
+	progress.Close()
+	os.Remove(opts.ProgressLog)
+
+	return nil
+}
+
+// modifiedACL describes the ACL key gets, its own without acl
+func modifiedACL(storage Storage, key string, acl string) string {
+	if len(acl) > 0 {
+		return acl
+	}
+
+	aclStorage, ok := storage.(ACLStorage)
+	if !ok {
+		return "kept"
+	}
+
+	current, err := aclStorage.GetACL(key)
+	if err != nil {
+		return "kept, not readable: " + err.Error()
+	}
+
+	return "kept, " + describeACL(current)
+}
+
+// describeACL lists the grants of an S3 AccessControlPolicy, other
+// backends store a canned ACL
+func describeACL(acl []byte) string {
+	var policy struct {
+		Grants []struct {
+			ID          string `xml:"Grantee>ID"`
+			DisplayName string `xml:"Grantee>DisplayName"`
+			URI         string `xml:"Grantee>URI"`
+			Permission  string
+		} `xml:"AccessControlList>Grant"`
+	}
+
+	if err := xml.Unmarshal(acl, &policy); err != nil {
+		if len(acl) == 0 {
+			return "none"
+		}
+		return string(acl)
+	}
+
+	var grants []string
+	for _, grant := range policy.Grants {
+		grantee := grant.DisplayName
+		if len(grantee) == 0 {
+			grantee = grant.ID
+		}
+		if len(grant.URI) > 0 {
+			grantee = path.Base(grant.URI)
+		}
+		grants = append(grants, grantee+" "+grant.Permission)
+	}
+
+	return strings.Join(grants, ", ")
+}
+
+func formatHeaders(headers http.Header) string {
+	var names []string
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var parts []string
+	for _, name := range names {
+		parts = append(parts, name+": "+strings.Join(headers[name], ", "))
+	}
+
+	return strings.Join(parts, "; ")
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestModifyObjects(t *testing.T) {
+	storage := newTempFilesystemStorage()
+	defer os.RemoveAll(storage.root)
+
+	headers := http.Header{
+		"Content-Type":    []string{"image/jpeg"},
+		"Cache-Control":   []string{"no-cache"},
+		"X-Amz-Meta-Test": []string{"old"},
+	}
+	storage.Put("img/a.jpg", strings.NewReader("a"), 1, headers, "public-read")
+	storage.Put("img/b.jpg", strings.NewReader("b"), 1, headers, "public-read")
+
+	dir, _ := ioutil.TempDir("", "s3pal_modify_")
+	defer os.RemoveAll(dir)
+	progressLog := filepath.Join(dir, "progress.log")
+
+	// b.jpg was done by an earlier, interrupted run
+	ioutil.WriteFile(progressLog, []byte("img/b.jpg\n"), 0600)
+
+	s3pal := getS3palWithStorage(storage)
+	add, _ := parseHeaders([]string{"Cache-Control:max-age=86400"})
+	opts := modifyOptions{
+		Prefix:        "img/",
+		AddHeaders:    add,
+		RemoveHeaders: []string{"x-amz-meta-test"},
+		ProgressLog:   progressLog,
+	}
+	assert.Nil(t, s3pal.modifyObjects(opts))
+
+	info, _ := storage.Head("img/a.jpg")
+	assert.Equal(t, "max-age=86400", info.Headers.Get("Cache-Control"))
+	assert.Equal(t, "image/jpeg", info.ContentType)
+	assert.Equal(t, "", info.Headers.Get("X-Amz-Meta-Test"))
+
+	info, _ = storage.Head("img/b.jpg")
+	assert.Equal(t, "no-cache", info.Headers.Get("Cache-Control"))
+
+	_, err := os.Stat(progressLog)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestModifyKeepsACL(t *testing.T) {
+	storage := newMemStorage()
+	storage.Put("a.txt", strings.NewReader("a"), 1, http.Header{}, "private")
+	storage.Put("b.txt", strings.NewReader("b"), 1, http.Header{}, "public-read")
+
+	dir, _ := ioutil.TempDir("", "s3pal_modify_")
+	defer os.RemoveAll(dir)
+
+	s3pal := getS3palWithStorage(storage)
+	add, _ := parseHeaders([]string{"Cache-Control:max-age=86400"})
+	opts := modifyOptions{AddHeaders: add, ProgressLog: filepath.Join(dir, "progress.log")}
+	assert.Nil(t, s3pal.modifyObjects(opts))
+
+	assert.Equal(t, "max-age=86400", storage.objects["a.txt"].headers.Get("Cache-Control"))
+	assert.Equal(t, "private", storage.objects["a.txt"].acl)
+	assert.Equal(t, "public-read", storage.objects["b.txt"].acl)
+
+	assert.Equal(t, "kept, private", modifiedACL(storage, "a.txt", ""))
+	assert.Equal(t, "public-read", modifiedACL(storage, "a.txt", "public-read"))
+}
+
+func TestDescribeACL(t *testing.T) {
+	policy := `<AccessControlPolicy><AccessControlList>
+<Grant><Grantee xsi:type="CanonicalUser"><ID>123</ID><DisplayName>jack</DisplayName></Grantee><Permission>FULL_CONTROL</Permission></Grant>
+<Grant><Grantee xsi:type="Group"><URI>http://acs.amazonaws.com/groups/global/AllUsers</URI></Grantee><Permission>READ</Permission></Grant>
+</AccessControlList></AccessControlPolicy>`
+
+	assert.Equal(t, "jack FULL_CONTROL, AllUsers READ", describeACL([]byte(policy)))
+	assert.Equal(t, "public-read", describeACL([]byte("public-read")))
+	assert.Equal(t, "none", describeACL(nil))
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMultipartThreshold   = 100 * 1024 * 1024
+	defaultMultipartPartSize    = 16 * 1024 * 1024
+	defaultMultipartConcurrency = 4
+
+	// S3 rejects parts (except the last) smaller than this
+	minMultipartPartSize = 5 * 1024 * 1024
+)
+
+// MultipartStorage is implemented by backends that can take an object in
+// parts. Uploads above aws.multipart_threshold use it when available.
+type MultipartStorage interface {
+	InitMultipart(key string, headers http.Header, acl string) (string, error)
+	PutPart(key string, uploadID string, n int, r io.ReadSeeker) (UploadPart, error)
+	CompleteMultipart(key string, uploadID string, parts []UploadPart) error
+	AbortMultipart(key string, uploadID string) error
+	// ListMultipart returns the unfinished uploads of keys with prefix
+	ListMultipart(prefix string) ([]MultipartUpload, error)
+}
+
+type MultipartUpload struct {
+	Key       string
+	UploadID  string
+	Initiated time.Time
+}
+
+type UploadPart struct {
+	N    int
+	ETag string
+	Size int64
+}
+
+func (s *S3pal) multipartSettings() (threshold int64, partSize int64, concurrency int) {
+	threshold = s.Config.Aws.MultipartThreshold
+	if threshold <= 0 {
+		threshold = defaultMultipartThreshold
+	}
+
+	partSize = s.Config.Aws.MultipartPartSize
+	if partSize <= 0 {
+		partSize = defaultMultipartPartSize
+	}
+
+	if partSize < minMultipartPartSize {
+		partSize = minMultipartPartSize
+	}
+
+	concurrency = s.Config.Aws.MultipartConcurrency
+	if concurrency <= 0 {
+		concurrency = defaultMultipartConcurrency
+	}
+
+	return
+}
+
+// putFile streams fd to key, in parallel parts if it is big enough and
+// the storage supports it. Multipart uploads are journaled so an
+// interrupted upload of the same file continues where it stopped.
+func (s *S3pal) putFile(fd *os.File, size int64, key string, headers http.Header) error {
+	storage := s.getStorage()
+	threshold, partSize, concurrency := s.multipartSettings()
+
+	mp, ok := storage.(MultipartStorage)
+	if !ok || size < threshold {
+		_, err := storage.Put(key, fd, size, headers, s.Config.Aws.ACL)
+		return err
+	}
+
+	journal := s.getJournal()
+	entry := journal.find(s.Config.Aws.Bucket, fd.Name())
+
+	if entry != nil && entry.Key == key && entry.PartSize > 0 {
+		fmt.Printf("Resuming upload of '%s' (%d parts already uploaded)\n", key, len(entry.Parts))
+		partSize = entry.PartSize
+	} else {
+		uploadID, err := mp.InitMultipart(key, headers, s.Config.Aws.ACL)
+		if err != nil {
+			return err
+		}
+
+		entry, err = journal.create(s.Config.Aws.Bucket, fd.Name(), key, uploadID, partSize)
+		if err != nil {
+			log.Printf("Upload can not be resumed, journal not writable: %v\n", err)
+			entry = &journalEntry{Key: key, UploadID: uploadID, PartSize: partSize, Parts: map[int]UploadPart{}}
+		}
+	}
+
+	parts, err := uploadParts(mp, key, entry.UploadID, fd, size, partSize, concurrency, entry.Parts, entry.addPart)
+	if err != nil {
+		if strings.Contains(err.Error(), "NoSuchUpload") {
+			// aborted or expired in the bucket, start over next time
+			entry.remove()
+		} else if len(entry.file) > 0 {
+			fmt.Printf("Upload of '%s' interrupted, run again to resume it.\n", key)
+		}
+		return err
+	}
+
+	err = mp.CompleteMultipart(key, entry.UploadID, parts)
+	if err == nil {
+		entry.remove()
+	}
+
+	return err
+}
+
+// uploadParts sends every part of fd not already in done with at most
+// concurrency uploads at a time and returns all parts in order. Each part
+// it sends is passed to onPart.
+func uploadParts(mp MultipartStorage, key string, uploadID string, fd io.ReaderAt, size int64, partSize int64, concurrency int, done map[int]UploadPart, onPart func(UploadPart)) ([]UploadPart, error) {
+	count := int((size + partSize - 1) / partSize)
+	parts := make([]UploadPart, count)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var firstErr error
+	sem := make(chan bool, concurrency)
+
+	for i := 0; i < count; i++ {
+		n := i + 1
+		if part, ok := done[n]; ok && part.Size > 0 {
+			parts[i] = part
+			continue
+		}
+
+		offset := int64(i) * partSize
+		length := partSize
+		if offset+length > size {
+			length = size - offset
+		}
+
+		wg.Add(1)
+		sem <- true
+		go func(i int, n int, offset int64, length int64) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			part, err := mp.PutPart(key, uploadID, n, io.NewSectionReader(fd, offset, length))
+
+			if err == nil && onPart != nil {
+				onPart(part)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			if err != nil {
+				if firstErr == nil {
+					firstErr = fmt.Errorf("part %d: %v", n, err)
+				}
+				return
+			}
+
+			parts[i] = part
+		}(i, n, offset, length)
+
+		mu.Lock()
+		failed := firstErr != nil
+		mu.Unlock()
+		if failed {
+			break
+		}
+	}
+
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+
+	return parts, nil
+}
+
+// abortOptions picks what uploads abort aborts. An upload with a journal
+// entry is s3pal's on this machine and may be resumed, one without could
+// be running somewhere else, so only old ones are taken as orphaned.
+type abortOptions struct {
+	Abort bool
+	// only abort this upload, even when it is journaled or young
+	UploadID  string
+	OlderThan time.Duration
+}
+
+// listMultipartUploads prints unfinished uploads under prefix and, with
+// opts.Abort, aborts the orphaned ones along with their journal entries.
+func (s *S3pal) listMultipartUploads(prefix string, opts abortOptions) error {
+	mp, ok := s.getStorage().(MultipartStorage)
+	if !ok {
+		return fmt.Errorf("storage type '%s' has no multipart uploads", s.Config.Storage.Type)
+	}
+
+	uploads, err := mp.ListMultipart(prefix)
+	if err != nil {
+		return err
+	}
+
+	journaled := map[string]*journalEntry{}
+	for _, entry := range s.getJournal().entries() {
+		journaled[entry.UploadID] = entry
+	}
+
+	found, aborted := 0, 0
+	for _, upload := range uploads {
+		if len(opts.UploadID) > 0 && upload.UploadID != opts.UploadID {
+			continue
+		}
+		found++
+
+		source := ""
+		entry, isJournaled := journaled[upload.UploadID]
+		if isJournaled {
+			source = fmt.Sprintf(" (from '%s', %d parts uploaded)", entry.Path, len(entry.Parts))
+		}
+
+		age := ""
+		if !upload.Initiated.IsZero() {
+			age = fmt.Sprintf(" started %s", upload.Initiated.Local().Format("2006-01-02 15:04"))
+		}
+
+		if !opts.Abort {
+			fmt.Printf("%s %s%s%s\n", upload.Key, upload.UploadID, age, source)
+			continue
+		}
+
+		if len(opts.UploadID) == 0 {
+			if isJournaled {
+				fmt.Printf("Skipping %s%s, resume it or pass --upload-id %s\n", upload.Key, source, upload.UploadID)
+				continue
+			}
+
+			if time.Since(upload.Initiated) < opts.OlderThan {
+				fmt.Printf("Skipping %s,%s, it may still be running\n", upload.Key, age)
+				continue
+			}
+		}
+
+		err = mp.AbortMultipart(upload.Key, upload.UploadID)
+		if err != nil {
+			fmt.Printf("Error aborting %s: %v\n", upload.Key, err)
+			continue
+		}
+
+		if isJournaled {
+			entry.remove()
+		}
+		fmt.Printf("Aborted %s%s\n", upload.Key, source)
+		aborted++
+	}
+
+	if len(opts.UploadID) > 0 && found == 0 {
+		return fmt.Errorf("no upload with id '%s'", opts.UploadID)
+	}
+
+	if opts.Abort {
+		fmt.Printf("\n%v Uploads, %v aborted\n", found, aborted)
+	} else {
+		fmt.Printf("\n%v Uploads\n", found)
+	}
+
+	return nil
+}
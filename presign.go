@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+const defaultPresignTTL = 900
+
+// PresignStorage is implemented by backends browsers can upload to
+// directly, without the file passing through the server.
+type PresignStorage interface {
+	// PresignPut returns a URL to PUT the object to
+	PresignPut(p uploadPolicy) (string, error)
+	// PresignPost returns the URL and form fields of an HTML form upload
+	// (S3 POST policy), the file goes in a last "file" field
+	PresignPost(p uploadPolicy) (string, map[string]string, error)
+}
+
+// uploadPolicy is what a direct upload must look like
+type uploadPolicy struct {
+	Key string
+	ACL string
+	// Content-Type and aws.upload_headers, uploads have to send exactly
+	// these
+	Headers http.Header
+	// the largest POST upload, no limit when 0
+	MaxSize int64
+	// the exact size of a PUT upload, not checked when 0
+	Size    int64
+	Expires time.Time
+}
+
+// uploadRejectedError is an upload the server does not take, as opposed to
+// one that failed
+type uploadRejectedError struct {
+	reason string
+}
+
+func (e *uploadRejectedError) Error() string {
+	return e.reason
+}
+
+func rejectUpload(format string, args ...interface{}) error {
+	return &uploadRejectedError{fmt.Sprintf(format, args...)}
+}
+
+// contentTypeAllowed checks server.allowed_content_types, which may have
+// wildcards like image/*. Everything is allowed when it is not set.
+func (s *S3pal) contentTypeAllowed(contentType string) bool {
+	allowed := s.Config.Server.AllowedContentTypes
+	if len(allowed) == 0 {
+		return true
+	}
+
+	contentType = strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))
+	for _, pattern := range allowed {
+		if matched, _ := path.Match(strings.ToLower(pattern), contentType); matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkUpload rejects uploads the server would not take
+func (s *S3pal) checkUpload(contentType string, size int64) error {
+	if !s.contentTypeAllowed(contentType) {
+		return rejectUpload("Content type '%s' is not allowed", contentType)
+	}
+
+	if max := s.maxPostBytes(); max > 0 && size > max {
+		return rejectUpload("Upload too big. %v > %v", size, max)
+	}
+
+	return nil
+}
+
+// directUpload is true when the embedded form should upload to the bucket
+// itself
+func (s *S3pal) directUpload() bool {
+	_, ok := s.getStorage().(PresignStorage)
+	return s.Config.Server.DirectUpload && ok
+}
+
+// presignUpload returns what a browser needs to upload filename straight
+// to the bucket as key (see makeFilename). method is
+// "post" (a form with a policy, the default) or "put" (a presigned URL,
+// size is required to enforce max_post_bytes).
+func (s *S3pal) presignUpload(filename string, key string, contentType string, size int64, method string) (map[string]interface{}, error) {
+	presigner, ok := s.getStorage().(PresignStorage)
+	if !ok {
+		return nil, fmt.Errorf("storage does not support direct uploads")
+	}
+
+	if len(contentType) == 0 {
+		contentType = mime.TypeByExtension(path.Ext(filename))
+	}
+	if len(contentType) == 0 {
+		contentType = "application/octet-stream"
+	}
+
+	if err := s.checkUpload(contentType, size); err != nil {
+		return nil, err
+	}
+
+	max := s.maxPostBytes()
+	if method == "put" && max > 0 && size <= 0 {
+		return nil, rejectUpload("size is required for PUT uploads")
+	}
+
+	headers := http.Header{}
+	headers.Set("Content-Type", contentType)
+	for name, value := range s.Config.Aws.UploadHeaders {
+		headers.Set(name, value)
+	}
+
+	ttl := s.Config.Server.PresignTTL
+	if ttl <= 0 {
+		ttl = defaultPresignTTL
+	}
+
+	policy := uploadPolicy{
+		Key:     key,
+		ACL:     s.Config.Aws.ACL,
+		Headers: headers,
+		Expires: time.Now().Add(time.Duration(ttl) * time.Second),
+	}
+
+	response := map[string]interface{}{
+		"status":   "ok",
+		"key":      policy.Key,
+		"file_url": s.makeUrl(policy.Key),
+		"expires":  policy.Expires.Unix(),
+	}
+
+	if method == "put" {
+		policy.Size = size
+
+		url, err := presigner.PresignPut(policy)
+		if err != nil {
+			return nil, err
+		}
+
+		// browsers set Content-Length themselves
+		sendHeaders := map[string]string{}
+		for name := range headers {
+			sendHeaders[name] = headers.Get(name)
+		}
+
+		response["method"] = "PUT"
+		response["url"] = url
+		response["headers"] = sendHeaders
+		return response, nil
+	}
+
+	if max > 0 {
+		policy.MaxSize = max
+	}
+
+	url, fields, err := presigner.PresignPost(policy)
+	if err != nil {
+		return nil, err
+	}
+
+	response["method"] = "POST"
+	response["url"] = url
+	response["fields"] = fields
+	return response, nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func getS3palWithS3Storage() *S3pal {
+	s3pal := getS3palWithStorage(&s3Storage{
+		config: AwsConfig{Bucket: "mybucket", Region: "eu-central-1"},
+		creds:  &awsCredentials{AccessKey: "AKID", SecretKey: "secret"},
+	})
+	s3pal.Config.Aws.Bucket = "mybucket"
+	s3pal.Config.Aws.UploadNameFormat = "%F"
+	s3pal.Config.Server.MaxPostBytes = 1000
+
+	return s3pal
+}
+
+func TestContentTypeAllowed(t *testing.T) {
+	s3pal := getS3palWithStorage(newMemStorage())
+	assert.True(t, s3pal.contentTypeAllowed("application/zip"))
+
+	s3pal.Config.Server.AllowedContentTypes = []string{"image/*", "application/pdf"}
+	assert.True(t, s3pal.contentTypeAllowed("image/png"))
+	assert.True(t, s3pal.contentTypeAllowed("Application/PDF; charset=binary"))
+	assert.False(t, s3pal.contentTypeAllowed("application/zip"))
+	assert.False(t, s3pal.contentTypeAllowed(""))
+}
+
+func TestPresignPost(t *testing.T) {
+	s3pal := getS3palWithS3Storage()
+
+	response, err := s3pal.presignUpload("cat.jpg", "pics/cat.jpg", "", 0, "post")
+	assert.Nil(t, err)
+	assert.Equal(t, "POST", response["method"])
+	assert.Equal(t, "pics/cat.jpg", response["key"])
+	assert.Equal(t, "https://mybucket.s3.eu-central-1.amazonaws.com/", response["url"])
+
+	fields := response["fields"].(map[string]string)
+	assert.Equal(t, "pics/cat.jpg", fields["key"])
+	assert.Equal(t, "image/jpeg", fields["Content-Type"])
+	assert.Equal(t, "max-age=60", fields["Cache-Control"])
+	assert.Equal(t, "public-read", fields["acl"])
+
+	data, _ := base64.StdEncoding.DecodeString(fields["policy"])
+	var policy struct {
+		Expiration string
+		Conditions []interface{}
+	}
+	assert.Nil(t, json.Unmarshal(data, &policy))
+	assert.Contains(t, policy.Conditions, map[string]interface{}{"bucket": "mybucket"})
+	assert.Contains(t, policy.Conditions, map[string]interface{}{"key": "pics/cat.jpg"})
+	assert.Contains(t, policy.Conditions, map[string]interface{}{"Content-Type": "image/jpeg"})
+	assert.Contains(t, policy.Conditions, []interface{}{"content-length-range", float64(0), float64(1000)})
+
+	signedAt, _ := time.Parse(sigV4TimeFormat, fields["x-amz-date"])
+	signer := sigV4{SecretKey: "secret", Region: "eu-central-1", Service: "s3"}
+	assert.Equal(t, signer.signature(signedAt, fields["policy"]), fields["x-amz-signature"])
+}
+
+func TestPresignPut(t *testing.T) {
+	s3pal := getS3palWithS3Storage()
+
+	response, err := s3pal.presignUpload("cat.jpg", "cat.jpg", "image/png", 500, "put")
+	assert.Nil(t, err)
+	assert.Equal(t, "PUT", response["method"])
+	assert.Equal(t, "image/png", response["headers"].(map[string]string)["Content-Type"])
+
+	signed, _ := url.Parse(response["url"].(string))
+	assert.Equal(t, "/cat.jpg", signed.Path)
+	assert.Equal(t, "public-read", signed.Query().Get("x-amz-acl"))
+	assert.Equal(t, "cache-control;content-length;content-type;host", signed.Query().Get("X-Amz-SignedHeaders"))
+}
+
+func TestPresignRejected(t *testing.T) {
+	s3pal := getS3palWithS3Storage()
+	s3pal.Config.Server.AllowedContentTypes = []string{"image/*"}
+
+	_, err := s3pal.presignUpload("notes.txt", "notes.txt", "text/plain", 10, "post")
+	assert.Contains(t, err.Error(), "'text/plain' is not allowed")
+
+	_, err = s3pal.presignUpload("cat.jpg", "cat.jpg", "", 1001, "post")
+	assert.True(t, strings.HasPrefix(err.Error(), "Upload too big"))
+
+	_, err = s3pal.presignUpload("cat.jpg", "cat.jpg", "", 0, "put")
+	_, rejected := err.(*uploadRejectedError)
+	assert.True(t, rejected)
+
+	_, err = getS3palWithStorage(newMemStorage()).presignUpload("cat.jpg", "cat.jpg", "", 0, "post")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// S3 takes at most this many keys per multi-object delete
+const deleteBatchSize = 1000
+
+// BatchDeleteStorage is implemented by backends that can delete many keys
+// in one request.
+type BatchDeleteStorage interface {
+	// DeleteMulti returns the keys that were not deleted with their
+	// error, the others are gone. err is set when the request failed as a
+	// whole.
+	DeleteMulti(keys []string) (failed map[string]error, err error)
+}
+
+// parseAge is time.ParseDuration plus days (30d) and weeks (2w)
+func parseAge(age string) (time.Duration, error) {
+	if len(age) > 1 {
+		unit := age[len(age)-1]
+		if unit == 'd' || unit == 'w' {
+			n, err := strconv.Atoi(age[:len(age)-1])
+			if err != nil {
+				return 0, fmt.Errorf("invalid age '%s'", age)
+			}
+
+			days := time.Duration(n) * 24 * time.Hour
+			if unit == 'w' {
+				days *= 7
+			}
+
+			return days, nil
+		}
+	}
+
+	return time.ParseDuration(age)
+}
+
+// matchKey matches pattern against the whole key, or only against its
+// last part when the pattern has no "/" (so *.tmp works in any folder).
+func matchKey(pattern string, key string) bool {
+	if !strings.Contains(pattern, "/") {
+		key = path.Base(key)
+	}
+
+	matched, _ := path.Match(pattern, key)
+	return matched
+}
+
+type rmOptions struct {
+	Prefix    string
+	OlderThan time.Duration
+	Match     string
+	DryRun    bool
+	Yes       bool
+	// ask before deleting more than this many objects
+	ConfirmAbove int
+}
+
+// keysToRemove lists the keys under prefix that pass the age and name
+// filters.
+func (s *S3pal) keysToRemove(opts rmOptions) ([]string, error) {
+	listing, err := s.listDetailed(opts.Prefix, "", "", 0, false, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	cutoff := time.Now().Add(-opts.OlderThan)
+
+	var keys []string
+	for _, item := range listing.Items {
+		if opts.OlderThan > 0 && !item.LastModified.Before(cutoff) {
+			continue
+		}
+
+		if len(opts.Match) > 0 && !matchKey(opts.Match, item.Key) {
+			continue
+		}
+
+		keys = append(keys, item.Key)
+	}
+
+	return keys, nil
+}
+
+func confirm(in io.Reader, out io.Writer, question string) bool {
+	fmt.Fprintf(out, "%s [y/N] ", question)
+
+	answer, _ := bufio.NewReader(in).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+
+	return answer == "y" || answer == "yes"
+}
+
+// deleteKeys removes keys in batches and returns how many are gone. Only
+// commands delete, so webhooks get them with the cli source.
+func (s *S3pal) deleteKeys(keys []string, out io.Writer) (int, error) {
+	storage := s.getStorage()
+	batcher, batched := storage.(BatchDeleteStorage)
+
+	deleted := 0
+	for start := 0; start < len(keys); start += deleteBatchSize {
+		end := start + deleteBatchSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+		batch := keys[start:end]
+
+		if batched {
+			failed, err := batcher.DeleteMulti(batch)
+			if err != nil {
+				s.notifyDeleteFailed(batch, err)
+				return deleted, err
+			}
+
+			if len(failed) > 0 {
+				var first error
+				for _, key := range batch {
+					if err, ok := failed[key]; ok {
+						s.notifyDeleteFailed([]string{key}, err)
+						if first == nil {
+							first = fmt.Errorf("%d keys not deleted, %s: %v", len(failed), key, err)
+						}
+						continue
+					}
+
+					fmt.Fprintf(out, "Deleted %s\n", key)
+					s.notifyDeleted([]string{key})
+					deleted++
+				}
+
+				return deleted, first
+			}
+		} else {
+			for i, key := range batch {
+				if err := storage.Delete(key); err != nil {
+					s.notifyDeleted(batch[:i])
+					s.notifyDeleteFailed(batch[i:i+1], err)
+					return deleted + i, err
+				}
+			}
+		}
+
+		for _, key := range batch {
+			fmt.Fprintf(out, "Deleted %s\n", key)
+		}
+		s.notifyDeleted(batch)
+		deleted += len(batch)
+	}
+
+	return deleted, nil
+}
+
+func (s *S3pal) notifyDeleted(keys []string) {
+	for _, key := range keys {
+		s.notify(webhookEvent{Event: "delete", Key: key, Source: cliSource.Name})
+	}
+}
+
+func (s *S3pal) notifyDeleteFailed(keys []string, err error) {
+	for _, key := range keys {
+		s.notify(webhookEvent{Event: "error", Key: key, Source: cliSource.Name, Error: err.Error()})
+	}
+}
+
+// removeObjects deletes keys plus whatever matches the prefix filters of
+// opts, after confirmation if there are many.
+func (s *S3pal) removeObjects(keys []string, opts rmOptions, in io.Reader, out io.Writer) error {
+	if len(opts.Prefix) > 0 || opts.OlderThan > 0 || len(opts.Match) > 0 {
+		matched, err := s.keysToRemove(opts)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, matched...)
+	}
+
+	if len(keys) == 0 {
+		fmt.Fprintf(out, "Nothing to delete.\n")
+		return nil
+	}
+
+	if opts.DryRun {
+		for _, key := range keys {
+			fmt.Fprintf(out, "Would delete %s\n", key)
+		}
+		fmt.Fprintf(out, "\n%v Objects would be deleted\n", len(keys))
+		return nil
+	}
+
+	if !opts.Yes && len(keys) > opts.ConfirmAbove {
+		question := fmt.Sprintf("Delete %d objects from bucket '%s'?", len(keys), s.Config.Aws.Bucket)
+		if !confirm(in, out, question) {
+			fmt.Fprintf(out, "Nothing deleted.\n")
+			return nil
+		}
+	}
+
+	deleted, err := s.deleteKeys(keys, out)
+	fmt.Fprintf(out, "\n%v Objects deleted\n", deleted)
+
+	return err
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseAge(t *testing.T) {
+	age, err := parseAge("30d")
+	assert.Nil(t, err)
+	assert.Equal(t, 30*24*time.Hour, age)
+
+	age, _ = parseAge("2w")
+	assert.Equal(t, 14*24*time.Hour, age)
+
+	age, _ = parseAge("90m")
+	assert.Equal(t, 90*time.Minute, age)
+
+	_, err = parseAge("xd")
+	assert.NotNil(t, err)
+}
+
+func TestMatchKey(t *testing.T) {
+	assert.True(t, matchKey("*.tmp", "uploads/2015/a.tmp"))
+	assert.False(t, matchKey("*.tmp", "uploads/2015/a.jpg"))
+	assert.True(t, matchKey("uploads/*/a.jpg", "uploads/2015/a.jpg"))
+	assert.False(t, matchKey("uploads/*.jpg", "uploads/2015/a.jpg"))
+}
+
+func TestRemoveObjects(t *testing.T) {
+	storage := newMemStorage()
+	storage.objects["uploads/a.tmp"] = &memObject{}
+	storage.objects["uploads/b.tmp"] = &memObject{}
+	storage.objects["uploads/c.jpg"] = &memObject{}
+	s3pal := getS3palWithStorage(storage)
+
+	var out bytes.Buffer
+	opts := rmOptions{Prefix: "uploads/", Match: "*.tmp", DryRun: true}
+	assert.Nil(t, s3pal.removeObjects(nil, opts, strings.NewReader(""), &out))
+	assert.Contains(t, out.String(), "Would delete uploads/a.tmp")
+	assert.Equal(t, 3, len(storage.objects))
+
+	// more than ConfirmAbove and no answer
+	opts.DryRun = false
+	opts.ConfirmAbove = 1
+	s3pal.removeObjects(nil, opts, strings.NewReader("\n"), &out)
+	assert.Equal(t, 3, len(storage.objects))
+
+	s3pal.removeObjects(nil, opts, strings.NewReader("y\n"), &out)
+	assert.Equal(t, 1, len(storage.objects))
+	assert.NotNil(t, storage.objects["uploads/c.jpg"])
+
+	s3pal.removeObjects([]string{"uploads/c.jpg"}, rmOptions{Yes: true}, strings.NewReader(""), &out)
+	assert.Equal(t, 0, len(storage.objects))
+}
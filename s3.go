@@ -2,9 +2,7 @@ package main
 
 import (
 	"fmt"
-	"github.com/mitchellh/goamz/aws"
-	"github.com/mitchellh/goamz/s3"
-	"io/ioutil"
+	"io"
 	"log"
 	"net/http"
 	"os"
@@ -13,20 +11,52 @@ import (
 	"time"
 )
 
-func (s *S3pal) getBucket() *s3.Bucket {
-	auth, err := aws.GetAuth(s.Config.Aws.AccessKey, s.Config.Aws.SecretKey)
+// uploadToS3 uploads a local file as filename, running the pre_upload and
+// post_upload hooks around it and notifying the webhooks. A pre_upload
+// hook can veto the upload (an *uploadRejectedError) or have another file
+// uploaded instead.
+func (s *S3pal) uploadToS3(path string, contentType string, filename string, source eventSource) error {
+	if len(contentType) == 0 {
+		contentType = "binary/octet-stream"
+	}
+
+	upload, err := s.newHookUpload(path, contentType, filename, source)
+	if err == nil {
+		err = s.runPreUploadHook(upload)
+	}
+	if err == nil {
+		err = s.uploadFile(upload.Path, upload.ContentType, filename)
+	}
 
 	if err != nil {
-		panic("Could not connect to S3 with your credentials.")
+		s.notify(webhookEvent{
+			Event:       "error",
+			Key:         filename,
+			URL:         s.makeUrl(filename),
+			ContentType: contentType,
+			Source:      source.Name,
+			ClientIP:    source.ClientIP,
+			Error:       err.Error(),
+		})
+		return err
 	}
 
-	client := s3.New(auth, aws.Regions[s.Config.Aws.Region])
-	bucket := client.Bucket(s.Config.Aws.Bucket)
+	s.runPostUploadHook(upload)
 
-	return bucket
+	s.notify(webhookEvent{
+		Event:       "upload",
+		Key:         filename,
+		URL:         upload.URL,
+		Size:        upload.Size,
+		ContentType: upload.ContentType,
+		Source:      source.Name,
+		ClientIP:    source.ClientIP,
+	})
+	return nil
 }
 
-func (s *S3pal) uploadToS3(path string, contentType string, filename string) (err error) {
+// uploadFile uploads a local file as filename without running hooks
+func (s *S3pal) uploadFile(path string, contentType string, filename string) (err error) {
 	fd, err := os.Open(path)
 	if err != nil {
 		log.Printf("Error opening temp: %v", err)
@@ -39,15 +69,12 @@ func (s *S3pal) uploadToS3(path string, contentType string, filename string) (er
 		contentType = "binary/octet-stream"
 	}
 
-	bucket := s.getBucket()
-
-	bytes, readErr := ioutil.ReadAll(fd)
-
-	if readErr != nil {
-		return readErr
+	fi, err := fd.Stat()
+	if err != nil {
+		return err
 	}
 
-	headers := map[string][]string{
+	headers := http.Header{
 		"Content-Type": []string{contentType},
 	}
 
@@ -55,7 +82,7 @@ func (s *S3pal) uploadToS3(path string, contentType string, filename string) (er
 		headers[key] = []string{value}
 	}
 
-	err = bucket.PutHeader(filename, bytes, headers, s3.ACL(s.Config.Aws.ACL))
+	err = s.putFile(fd, fi.Size(), filename, headers)
 
 	if err != nil {
 		log.Printf("Error: %v\n", err)
@@ -67,64 +94,194 @@ func (s *S3pal) uploadToS3(path string, contentType string, filename string) (er
 	return nil
 }
 
-func (s *S3pal) listS3Bucket(prefix string, urls bool, doSign bool, signTTL int64) ([]string, error) {
+// listObjects follows the storage's markers until limit objects (or all
+// of them when limit is 0) with prefix that sort after startAfter are
+// listed. The NextMarker of the result continues the listing, it is empty
+// once there is nothing more.
+func (s *S3pal) listObjects(prefix string, delim string, startAfter string, limit int) (*ListResult, error) {
+	storage := s.getStorage()
+	result := &ListResult{}
+	marker := startAfter
 
-	bucket := s.getBucket()
-	listresp, err := bucket.List(prefix, "", "", 0)
+	for {
+		max := 1000
+		if limit > 0 {
+			max = limit - len(result.Objects) - len(result.CommonPrefixes)
+			if max > 1000 {
+				max = 1000
+			}
+		}
+
+		page, err := storage.List(prefix, delim, marker, max)
+		if err != nil {
+			return nil, err
+		}
+
+		result.Objects = append(result.Objects, page.Objects...)
+		result.CommonPrefixes = append(result.CommonPrefixes, page.CommonPrefixes...)
+
+		if !page.IsTruncated || len(page.NextMarker) == 0 || page.NextMarker == marker {
+			break
+		}
+
+		marker = page.NextMarker
+		result.NextMarker = marker
+
+		if limit > 0 && len(result.Objects)+len(result.CommonPrefixes) >= limit {
+			result.IsTruncated = true
+			return result, nil
+		}
+	}
+
+	result.NextMarker = ""
+	return result, nil
+}
+
+// ListItem is one object of a listing as printed by `s3pal list` and
+// returned by /list?detail=true
+type ListItem struct {
+	Key          string    `json:"key"`
+	Size         int64     `json:"size"`
+	LastModified time.Time `json:"last_modified"`
+	ETag         string    `json:"etag"`
+	StorageClass string    `json:"storage_class"`
+	URL          string    `json:"url"`
+}
+
+// Listing is a page of ListItems. With a delimiter, keys below the next
+// delimiter are grouped into Prefixes ("folders").
+type Listing struct {
+	Items    []ListItem
+	Prefixes []string
+	Next     string
+}
+
+// listDetailed returns the objects under prefix and, in Next, the marker
+// to continue from if limit cut the listing short.
+func (s *S3pal) listDetailed(prefix string, delim string, startAfter string, limit int, doSign bool, signTTL int64) (*Listing, error) {
+	storage := s.getStorage()
+	listresp, err := s.listObjects(prefix, delim, startAfter, limit)
 
-	var result []string
 	if err != nil {
-		return result, err
+		return nil, err
+	}
+
+	result := &Listing{
+		Prefixes: listresp.CommonPrefixes,
+		Next:     listresp.NextMarker,
 	}
 
 	now := time.Now()
 	ttl := time.Duration(signTTL) * time.Second
 	signExpires := now.Add(ttl)
 
-	if err != nil {
-		log.Printf("Error: %v\n", err)
-	} else {
-		for _, obj := range listresp.Contents {
-			if len(prefix) == 0 || (len(prefix) > 0 && strings.HasPrefix(obj.Key, prefix)) {
-				if urls {
-					if doSign {
-						result = append(result, bucket.SignedURL(obj.Key, signExpires))
-					} else {
-						result = append(result, bucket.URL(obj.Key))
-					}
-				} else {
-					result = append(result, obj.Key)
-				}
+	for _, obj := range listresp.Objects {
+		if len(prefix) == 0 || (len(prefix) > 0 && strings.HasPrefix(obj.Key, prefix)) {
+			item := ListItem{
+				Key:          obj.Key,
+				Size:         obj.Size,
+				LastModified: obj.LastModified,
+				ETag:         strings.Trim(obj.ETag, `"`),
+				StorageClass: obj.StorageClass,
 			}
+
+			if doSign {
+				item.URL = storage.SignedURL(obj.Key, signExpires)
+			} else {
+				item.URL = storage.URL(obj.Key)
+			}
+
+			result.Items = append(result.Items, item)
 		}
 	}
 
 	return result, nil
 }
 
-func (s *S3pal) uploadPathOrURL(filePath string, prefix string) (string, error) {
+// names returns the keys (or URLs) of the listing's items
+func (l *Listing) names(urls bool) []string {
+	var result []string
+	for _, item := range l.Items {
+		if urls {
+			result = append(result, item.URL)
+		} else {
+			result = append(result, item.Key)
+		}
+	}
+
+	return result
+}
+
+// listS3Bucket returns keys (or URLs) under prefix and the marker to
+// continue from if limit cut the listing short.
+func (s *S3pal) listS3Bucket(prefix string, startAfter string, limit int, urls bool, doSign bool, signTTL int64) ([]string, string, error) {
+	listing, err := s.listDetailed(prefix, "", startAfter, limit, doSign, signTTL)
+
+	var result []string
+	if err != nil {
+		return result, "", err
+	}
+
+	return listing.names(urls), listing.Next, nil
+}
+
+// uploadPathOrURL uploads a local file or downloads and uploads a URL.
+// Downloads bigger than maxDownload bytes are rejected, negative is any
+// size.
+func (s *S3pal) uploadPathOrURL(filePath string, prefix string, maxDownload int64, source eventSource) (string, error) {
+	return s.uploadPathOrURLAs(filePath, s.makeFilename(prefix, path.Base(filePath)), maxDownload, source)
+}
+
+// uploadPathOrURLAs is uploadPathOrURL with the key made already
+func (s *S3pal) uploadPathOrURLAs(filePath string, key string, maxDownload int64, source eventSource) (string, error) {
 	fmt.Printf("\nUploading '%s' to S3 Bucket '%s'...\n", filePath, s.Config.Aws.Bucket)
 	var toUploadPath string
 
 	_, err := os.Stat(filePath)
 	if err == nil {
-		f, err := os.Open(filePath)
-		if err != nil {
-			return "", err
-		}
-		toUploadPath = f.Name()
+		toUploadPath = filePath
 	} else {
-		toUploadPath, err = downloadURL(filePath)
+		toUploadPath, err = downloadURL(filePath, maxDownload)
 		if err != nil {
 			return "", err
 		}
 	}
 
-	bytes, err := ioutil.ReadFile(toUploadPath)
-	contentType := http.DetectContentType(bytes)
-	newFilename := s.makeFilename(prefix, path.Base(filePath))
+	return s.uploadLocalFile(toUploadPath, key, source)
+}
+
+// uploadLocalFile uploads a file as key with its sniffed content type and
+// returns the key it got: an interrupted upload of the file is continued
+// under the key it had then.
+func (s *S3pal) uploadLocalFile(filePath string, key string, source eventSource) (string, error) {
+	contentType, err := detectContentType(filePath)
+	if err != nil {
+		return "", err
+	}
+
+	if entry := s.getJournal().find(s.Config.Aws.Bucket, filePath); entry != nil {
+		key = entry.Key
+	}
 
-	err = s.uploadToS3(toUploadPath, contentType, newFilename)
+	err = s.uploadToS3(filePath, contentType, key, source)
+
+	return key, err
+}
+
+// detectContentType sniffs only the first 512 bytes of the file, which is
+// all http.DetectContentType looks at.
+func detectContentType(path string) (string, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer fd.Close()
+
+	buf := make([]byte, 512)
+	n, err := io.ReadFull(fd, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
 
-	return newFilename, err
+	return http.DetectContentType(buf[:n]), nil
 }
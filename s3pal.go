@@ -14,13 +14,41 @@ import (
 	"path"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
 type S3palConfig struct {
 	Aws               AwsConfig
+	Storage           StorageConfig
 	Server            ServerConfig
 	FolderWatchUpload FolderWatchUploadConfig
+	Hooks             HooksConfig
+	Webhooks          []WebhookConfig
+}
+
+// WebhookConfig is a [[webhooks]] entry, notified of uploads, deletes and
+// failed uploads (see webhooks.go)
+type WebhookConfig struct {
+	URL string `toml:"url"`
+	// upload, delete or error, all of them if not set
+	Events []string `toml:"events"`
+	// only keys with this prefix
+	Prefix string `toml:"prefix"`
+	// signs the body, see webhookSignature
+	Secret string `toml:"secret"`
+	// attempts before giving up, 5 if not set
+	MaxAttempts int `toml:"max_attempts"`
+	// where deliveries that never succeeded go, one JSON object per line
+	DeadLetter string `toml:"dead_letter"`
+}
+
+// HooksConfig is [hooks], commands run around every upload (see hooks.go)
+type HooksConfig struct {
+	PreUpload  string `toml:"pre_upload"`
+	PostUpload string `toml:"post_upload"`
+	// seconds a hook may run before it is killed, 30 if not set
+	Timeout int64 `toml:"timeout"`
 }
 
 type ServerConfig struct {
@@ -38,6 +66,39 @@ type ServerConfig struct {
 	SignURL           bool     `toml:"sign_url"`
 	AllowedOrigins    []string `toml:"allowed_origins"`
 	ShowUploadForm    bool     `toml:"show_upload_form"`
+	// uploads with other content types are rejected, may use image/*
+	AllowedContentTypes []string `toml:"allowed_content_types"`
+	// the embedded form uploads straight to the bucket (/upload/presign)
+	DirectUpload bool       `toml:"direct_upload"`
+	PresignTTL   int64      `toml:"presign_ttl"`
+	Auth         AuthConfig `toml:"auth"`
+}
+
+// AuthConfig is [server.auth]. The server is open to anyone when none of
+// keys, users and hmac_secret are set.
+type AuthConfig struct {
+	Keys  []AuthKeyConfig  `toml:"keys"`
+	Users []AuthUserConfig `toml:"users"`
+	// signs tokens minted with s3pal token (or by your backend)
+	HMACSecret string `toml:"hmac_secret"`
+	Realm      string `toml:"realm"`
+}
+
+// AuthKeyConfig is an API key. Without prefixes and operations it may do
+// everything.
+type AuthKeyConfig struct {
+	Key        string   `toml:"key"`
+	Name       string   `toml:"name"`
+	Prefixes   []string `toml:"prefixes"`
+	Operations []string `toml:"operations"`
+}
+
+// AuthUserConfig is a basic auth login, for the embedded upload form
+type AuthUserConfig struct {
+	Name       string   `toml:"name"`
+	Password   string   `toml:"password"`
+	Prefixes   []string `toml:"prefixes"`
+	Operations []string `toml:"operations"`
 }
 
 type FolderWatchUploadConfig struct {
@@ -47,25 +108,64 @@ type FolderWatchUploadConfig struct {
 	AutoClipboard       bool   `toml:"auto_clipboard"`
 	AutoClipboardPrefix string `toml:"auto_clipboard_prefix"`
 	Debug               bool   `toml:"debug"`
+	// watch subfolders too, also the ones created later
+	Recursive bool `toml:"recursive"`
+	// what was uploaded already, see watchstate.go
+	StateFile string `toml:"state_file"`
+	// do not upload the files added while watch-folder was not running
+	NoCatchUp bool `toml:"no_catch_up"`
+	// skip files with content uploaded from another path already
+	DedupeContent bool `toml:"dedupe_content"`
+	// only upload files matching one of these, relative to the watched
+	// folder (like sync --include)
+	Include []string `toml:"include"`
+	Exclude []string `toml:"exclude"`
+	// in bytes, 0 for no limit
+	MinSize int64 `toml:"min_size"`
+	MaxSize int64 `toml:"max_size"`
+	// upload swap files, .DS_Store, .part files and the like too
+	NoDefaultIgnore bool `toml:"no_default_ignore"`
+}
+
+type StorageConfig struct {
+	Type    string `toml:"type"`
+	Root    string `toml:"root"`
+	BaseURL string `toml:"base_url"`
 }
 
 type AwsConfig struct {
-	AccessKey        string `toml:"access_key"`
-	SecretKey        string `toml:"secret_key"`
-	Bucket           string
-	Region           string
-	ACL              string
-	UploadNameFormat string            `toml:"upload_name_format"`
-	UploadHeaders    map[string]string `toml:"upload_headers"`
+	AccessKey string `toml:"access_key"`
+	SecretKey string `toml:"secret_key"`
+	// without keys credentials come from the environment, ~/.aws or this
+	// command (see credentials.go)
+	Profile           string `toml:"profile"`
+	CredentialProcess string `toml:"credential_process"`
+	Bucket            string
+	Region            string
+	ACL               string
+	Endpoint          string            `toml:"endpoint"`
+	PathStyle         bool              `toml:"path_style"`
+	DisableSSL        bool              `toml:"disable_ssl"`
+	UploadNameFormat  string            `toml:"upload_name_format"`
+	UploadHeaders     map[string]string `toml:"upload_headers"`
+	KvPrefix          string            `toml:"kv_prefix"`
+
+	MultipartThreshold   int64  `toml:"multipart_threshold"`
+	MultipartPartSize    int64  `toml:"multipart_part_size"`
+	MultipartConcurrency int    `toml:"multipart_concurrency"`
+	MultipartJournal     string `toml:"multipart_journal"`
 }
 
+// ListCache holds /list responses by prefix and query
 type ListCache struct {
-	items   map[string][]string
+	items   map[string]interface{}
 	timeout map[string]int64
+	mu      sync.Mutex
 }
 
 type S3pal struct {
-	Config S3palConfig
+	Config  S3palConfig
+	Storage Storage
 }
 
 func StringInSlice(a string, list []string) bool {
@@ -93,16 +193,12 @@ func IsValidACL(acl string) bool {
 }
 
 func (s *S3pal) makeUrl(filename string) string {
-	subdomain := "s3"
-
-	if s.Config.Aws.Region != "us-east" {
-		subdomain = subdomain + "-" + s.Config.Aws.Region
-	}
-
-	return fmt.Sprintf("https://%s.amazonaws.com/%s/%s", subdomain, s.Config.Aws.Bucket, filename)
+	return s.getStorage().URL(filename)
 }
 
-func downloadURL(url string) (string, error) {
+// downloadURL saves url to a temp file. Files bigger than max bytes are
+// rejected, negative max is any size.
+func downloadURL(url string, max int64) (string, error) {
 	client := &http.Client{}
 	req, err := http.NewRequest("GET", url, nil)
 
@@ -122,22 +218,46 @@ func downloadURL(url string) (string, error) {
 		return "", fmt.Errorf("%v returned by %v", resp.StatusCode, url)
 	}
 
+	if max >= 0 && resp.ContentLength > max {
+		return "", rejectUpload("Download too big. %v > %v", resp.ContentLength, max)
+	}
+
 	tmp, err := ioutil.TempFile("/tmp", "downloaded_")
 	if err != nil {
 		return "", err
 	}
 	defer tmp.Close()
 
-	_, err = io.Copy(tmp, resp.Body)
+	// the Content-Length may be missing or wrong, read one byte more than
+	// allowed to tell
+	body := io.Reader(resp.Body)
+	if max >= 0 {
+		body = io.LimitReader(body, max+1)
+	}
+
+	n, err := io.Copy(tmp, body)
 	if err != nil {
+		os.Remove(tmp.Name())
 		return "", err
 	}
 
+	if max >= 0 && n > max {
+		os.Remove(tmp.Name())
+		return "", rejectUpload("Download too big. > %v", max)
+	}
+
 	return tmp.Name(), nil
 }
 
 // %U (uuid) %F (full filename) %N (name only w/o extension) %E(extension) %T(unix timestamp)
 func (s *S3pal) makeFilename(prefix string, filename string) string {
+	return s.makeFilenameIn(prefix, "", filename)
+}
+
+// makeFilenameIn is makeFilename for a file in dir (slash separated),
+// which %P is replaced with. watch-folder uses the folder relative to the
+// watched one.
+func (s *S3pal) makeFilenameIn(prefix string, dir string, filename string) string {
 	now := time.Now()
 	t := now.UTC()
 	day := fmt.Sprintf("%02d", t.Day())
@@ -146,6 +266,9 @@ func (s *S3pal) makeFilename(prefix string, filename string) string {
 	uuid := uuid.NewUUID().String()
 	ts := strconv.FormatInt(now.Unix(), 10)
 
+	// a client's file name can not move the upload out of the prefix
+	filename = path.Base(filename)
+
 	ext := path.Ext(filename)
 	name := strings.Replace(filename, ext, "", -1)
 
@@ -164,6 +287,7 @@ func (s *S3pal) makeFilename(prefix string, filename string) string {
 	newFilename = strings.Replace(newFilename, "%M", month, -1)
 	newFilename = strings.Replace(newFilename, "%D", day, -1)
 	newFilename = strings.Replace(newFilename, "%U", uuid, -1)
+	newFilename = strings.Replace(newFilename, "%P", dir, -1)
 
 	return path.Join(prefix, newFilename)
 }
@@ -171,6 +295,7 @@ func (s *S3pal) makeFilename(prefix string, filename string) string {
 var (
 	app        = kingpin.New("s3pal", "A server + cli S3 tool for uploading and listing files")
 	configPath = app.Flag("config", "The path to a  non-default location config file.").Default("s3pal.toml").Short('c').String()
+	profile    = app.Flag("profile", "AWS profile from ~/.aws/credentials to use (instead of keys in the config file)").String()
 
 	// upload
 	uploadCmd    = app.Command("upload", "Upload a local or remote file to S3.")
@@ -183,6 +308,9 @@ var (
 	folderWatchUploadPath   = folderWatchUploadCmd.Arg("path", "Folder to watch for new files.").String()
 	folderWatchUploadBucket = folderWatchUploadCmd.Flag("bucket", "S3 bucket name to upload to (if different from default)").String()
 	folderWatchUploadPrefix = folderWatchUploadCmd.Flag("prefix", "S3 prefix to prepend to filename when uploading (if different from default)").String()
+	folderWatchRecursive    = folderWatchUploadCmd.Flag("recursive", "Upload new files in subfolders too (use %P in upload_name_format to keep their folders)").Short('r').Bool()
+	folderWatchInclude      = folderWatchUploadCmd.Flag("include", "Only upload files matching this pattern (repeatable)").Strings()
+	folderWatchExclude      = folderWatchUploadCmd.Flag("exclude", "Do not upload files matching this pattern (repeatable)").Strings()
 
 	// server
 	serverCmd        = app.Command("server", "Run a server for handling uploads to S3")
@@ -193,13 +321,111 @@ var (
 	serverDebug      = serverCmd.Flag("debug", "Server runs in debug mode.").Bool()
 	serverStaticPath = serverCmd.Flag("static-path", "Serve this directory on /static").String()
 
+	// multipart uploads
+	uploadsCmd    = app.Command("uploads", "List or abort unfinished multipart uploads in the bucket.")
+	uploadsAction = uploadsCmd.Arg("action", "list or abort").Default("list").String()
+	uploadsBucket = uploadsCmd.Flag("bucket", "S3 bucket with the uploads (if different from default)").Short('b').String()
+	uploadsPrefix = uploadsCmd.Flag("prefix", "Only uploads of keys with this prefix").String()
+	uploadsOlder  = uploadsCmd.Flag("older-than", "Only abort uploads started longer ago than this (30d, 2w, 12h)").Default("1d").String()
+	uploadsID     = uploadsCmd.Flag("upload-id", "Only this upload, abort even if it is journaled or young").String()
+
 	// list
-	listCmd     = app.Command("list", "List the contents of the bucket")
-	listPrefix  = listCmd.Flag("prefix", "Only list objects that have this prefix").String()
-	listBucket  = listCmd.Flag("bucket", "S3 bucket for listing objects.").Short('b').String()
-	listUrls    = listCmd.Flag("url", "List full urls and not just key names").Bool()
-	listSign    = listCmd.Flag("sign", "Sign the S3 urls").Bool()
-	listSignTTL = listCmd.Flag("sign-ttl", "TTL for signed URLs").Default("300").Int64()
+	listCmd        = app.Command("list", "List the contents of the bucket")
+	listPrefix     = listCmd.Flag("prefix", "Only list objects that have this prefix").String()
+	listBucket     = listCmd.Flag("bucket", "S3 bucket for listing objects.").Short('b').String()
+	listUrls       = listCmd.Flag("url", "List full urls and not just key names").Bool()
+	listSign       = listCmd.Flag("sign", "Sign the S3 urls").Bool()
+	listSignTTL    = listCmd.Flag("sign-ttl", "TTL for signed URLs").Default("300").Int64()
+	listLimit      = listCmd.Flag("limit", "List at most this many objects (all if not set)").Int()
+	listStartAfter = listCmd.Flag("start-after", "Only list keys that sort after this one").String()
+	listLong       = listCmd.Flag("long", "Show last modified, size and storage class").Short('l').Bool()
+	listJSON       = listCmd.Flag("json", "Print objects with all their details as JSON").Bool()
+	listCSV        = listCmd.Flag("csv", "Print objects with all their details as CSV").Bool()
+	listDirs       = listCmd.Flag("dirs", "Show folders (keys up to the next /) instead of everything below the prefix").Bool()
+
+	// get
+	getCmd         = app.Command("get", "Download an object, or everything under a prefix with --recursive.")
+	getKey         = getCmd.Arg("key", "Key to download (prefix with --recursive)").Required().String()
+	getDest        = getCmd.Arg("dest", "File or folder to download to, - for stdout (defaults to the current folder)").String()
+	getBucket      = getCmd.Flag("bucket", "S3 bucket to download from (if different from default)").Short('b').String()
+	getIsRecursive = getCmd.Flag("recursive", "Download every object under the key prefix, keeping their paths").Short('r').Bool()
+	getConcurrency = getCmd.Flag("concurrency", "Number of downloads at the same time with --recursive").Default("4").Int()
+
+	// cp and mv
+	cpCmd       = app.Command("cp", "Copy objects within the bucket or to another one (s3://bucket/key) without downloading them.")
+	cpSrc       = cpCmd.Arg("src", "Key (or prefix with --recursive) to copy, s3://bucket/key for another bucket").Required().String()
+	cpDst       = cpCmd.Arg("dst", "Key (or prefix with --recursive) to copy to, s3://bucket/key for another bucket").Required().String()
+	cpRecursive = cpCmd.Flag("recursive", "Copy every object under the src prefix").Short('r').Bool()
+	cpHeaders   = cpCmd.Flag("header", "Set this header (Name:Value) on the copies instead of keeping the source's").Strings()
+	cpACL       = cpCmd.Flag("acl", "ACL of the copies (the source's is kept if not set)").String()
+	mvCmd       = app.Command("mv", "Move objects within the bucket or to another one (s3://bucket/key) without downloading them.")
+	mvSrc       = mvCmd.Arg("src", "Key (or prefix with --recursive) to move, s3://bucket/key for another bucket").Required().String()
+	mvDst       = mvCmd.Arg("dst", "Key (or prefix with --recursive) to move to, s3://bucket/key for another bucket").Required().String()
+	mvRecursive = mvCmd.Flag("recursive", "Move every object under the src prefix").Short('r').Bool()
+	mvHeaders   = mvCmd.Flag("header", "Set this header (Name:Value) on the moved objects instead of keeping the source's").Strings()
+	mvACL       = mvCmd.Flag("acl", "ACL of the moved objects (the source's is kept if not set)").String()
+
+	// sync
+	syncCmd         = app.Command("sync", "Upload the new and changed files of a folder to s3://bucket/prefix, or download them the other way around.")
+	syncSrc         = syncCmd.Arg("src", "Local folder or s3://bucket/prefix to sync from").Required().String()
+	syncDst         = syncCmd.Arg("dst", "s3://bucket/prefix or local folder to sync to").Required().String()
+	syncDelete      = syncCmd.Flag("delete", "Delete what is in dst but not in src").Bool()
+	syncDryRun      = syncCmd.Flag("dry-run", "Print what would be transferred and deleted").Bool()
+	syncInclude     = syncCmd.Flag("include", "Only sync files matching this pattern (repeatable)").Strings()
+	syncExclude     = syncCmd.Flag("exclude", "Do not sync files matching this pattern (repeatable)").Strings()
+	syncCompare     = syncCmd.Flag("compare", "How to tell a file changed besides its size: md5 or mtime").Default("md5").String()
+	syncConcurrency = syncCmd.Flag("concurrency", "Number of transfers at the same time").Default("4").Int()
+	syncManifest    = syncCmd.Flag("manifest", "Write what was transferred and deleted to this JSON file").String()
+
+	// modify
+	modifyCmd          = app.Command("modify", "Change headers and ACL of existing objects (copies every object onto itself).")
+	modifyPrefix       = modifyCmd.Flag("prefix", "Modify objects with this prefix").String()
+	modifyBucket       = modifyCmd.Flag("bucket", "S3 bucket to modify (if different from default)").Short('b').String()
+	modifyMatch        = modifyCmd.Flag("match", "Only modify keys matching this pattern (*.jpg)").String()
+	modifyAddHeader    = modifyCmd.Flag("add-header", "Set this header (Name:Value, repeatable)").Strings()
+	modifyRemoveHeader = modifyCmd.Flag("remove-header", "Remove this header (repeatable)").Strings()
+	modifyACL          = modifyCmd.Flag("acl", "ACL to set (each object's is kept if not set)").String()
+	modifyDryRun       = modifyCmd.Flag("dry-run", "Print the headers every object would get").Bool()
+	modifyConcurrency  = modifyCmd.Flag("concurrency", "Number of objects modified at the same time").Default("8").Int()
+	modifyProgressLog  = modifyCmd.Flag("progress-log", "File of the keys already modified, to resume an interrupted run").String()
+
+	// rm
+	rmCmd          = app.Command("rm", "Delete objects by key, or everything matching --prefix/--older-than/--match.")
+	rmKeys         = rmCmd.Arg("keys", "Keys to delete").Strings()
+	rmBucket       = rmCmd.Flag("bucket", "S3 bucket to delete from (if different from default)").Short('b').String()
+	rmPrefix       = rmCmd.Flag("prefix", "Delete objects with this prefix").String()
+	rmOlderThan    = rmCmd.Flag("older-than", "Only delete objects older than this (30d, 2w, 12h)").String()
+	rmMatch        = rmCmd.Flag("match", "Only delete keys matching this pattern (*.tmp)").String()
+	rmDryRun       = rmCmd.Flag("dry-run", "Print what would be deleted").Bool()
+	rmYes          = rmCmd.Flag("yes", "Do not ask before deleting many objects").Short('y').Bool()
+	rmConfirmAbove = rmCmd.Flag("confirm-above", "Ask before deleting more than this many objects").Default("10").Int()
+
+	// kv
+	kvCmd     = app.Command("kv", "Use the bucket as a key/value store (values are kept under aws.kv_prefix).")
+	kvAction  = kvCmd.Arg("action", "set, get, del or list").Required().String()
+	kvKey     = kvCmd.Arg("key", "Key (prefix for list)").String()
+	kvValue   = kvCmd.Arg("value", "Value to set, read from stdin if not given").String()
+	kvBucket  = kvCmd.Flag("bucket", "S3 bucket of the store (if different from default)").Short('b').String()
+	kvIfMatch = kvCmd.Flag("if-match", "Only set while the key still has this ETag (best effort for del)").String()
+	kvCreate  = kvCmd.Flag("create", "Only set the key if it does not exist yet").Bool()
+	kvType    = kvCmd.Flag("content-type", "Content-Type of the value (application/json if it is JSON)").String()
+
+	// info
+	infoCmd = app.Command("info", "Show the config file, bucket and where the AWS credentials come from")
+
+	// token
+	tokenCmd        = app.Command("token", "Create a token for the server signed with server.auth.hmac_secret")
+	tokenPrefixes   = tokenCmd.Flag("prefix", "Only allow keys with this prefix (repeatable)").Strings()
+	tokenOperations = tokenCmd.Flag("op", "Only allow this operation: upload, list, read, kv_read or kv_write (repeatable)").Strings()
+	tokenTTL        = tokenCmd.Flag("ttl", "Seconds the token is valid").Default("3600").Int64()
+	tokenName       = tokenCmd.Flag("name", "Name of the token in the server log").String()
+
+	// tree
+	treeCmd    = app.Command("tree", "Show the bucket as folders with their object counts and sizes")
+	treePrefix = treeCmd.Arg("prefix", "Only show folders under this prefix").String()
+	treeBucket = treeCmd.Flag("bucket", "S3 bucket to show (if different from default)").Short('b').String()
+	treeFiles  = treeCmd.Flag("files", "Show objects too, not only folders").Bool()
+	treeDepth  = treeCmd.Flag("depth", "Only show this many levels of folders (all if not set)").Int()
 )
 
 func Exists(name string) bool {
@@ -243,6 +469,29 @@ func main() {
 		fmt.Printf("\nValid ACL options are: %v\n", strings.Join(ValidACLs, ", "))
 	}
 
+	if err := s3pal.checkWebhookConfig(); err != nil {
+		fmt.Printf("\nNot Running! %v\n\n", err)
+		return
+	}
+
+	// deliveries are made in the background, let them finish
+	defer waitWebhooks()
+
+	if len(*profile) > 0 {
+		// a profile on the command line wins over keys in the config
+		s3pal.Config.Aws.Profile = *profile
+		s3pal.Config.Aws.AccessKey = ""
+		s3pal.Config.Aws.SecretKey = ""
+	}
+
+	if parsed != infoCmd.FullCommand() && parsed != tokenCmd.FullCommand() && s3pal.Config.Storage.Type != "filesystem" {
+		if _, err := resolveCredentials(s3pal.Config.Aws); err != nil {
+			fmt.Printf("\nNot Running! %v\n\n", err)
+			fmt.Printf("Run 's3pal info' to see where s3pal looks for them.\n\n")
+			return
+		}
+	}
+
 	switch parsed {
 
 	// upload local file or URL
@@ -251,7 +500,7 @@ func main() {
 			s3pal.Config.Aws.Bucket = *uploadBucket
 		}
 
-		_, err := s3pal.uploadPathOrURL(*uploadPath, *uploadPrefix)
+		_, err := s3pal.uploadPathOrURL(*uploadPath, *uploadPrefix, -1, cliSource)
 
 		if err != nil {
 			fmt.Printf("\nNot Uploaded! Error: %v\n\n", err)
@@ -271,6 +520,18 @@ func main() {
 			s3pal.Config.FolderWatchUpload.Prefix = *folderWatchUploadPrefix
 		}
 
+		if *folderWatchRecursive {
+			s3pal.Config.FolderWatchUpload.Recursive = true
+		}
+
+		if len(*folderWatchInclude) > 0 {
+			s3pal.Config.FolderWatchUpload.Include = *folderWatchInclude
+		}
+
+		if len(*folderWatchExclude) > 0 {
+			s3pal.Config.FolderWatchUpload.Exclude = *folderWatchExclude
+		}
+
 		s3pal.startDropFolder()
 
 	// Start server
@@ -314,22 +575,322 @@ func main() {
 
 		s3pal.Config.Server.Port = port
 
+		if err := s3pal.checkAuthConfig(); err != nil {
+			fmt.Printf("\nNot Running! %v\n\n", err)
+			return
+		}
+
 		s3pal.startServer()
 
+	// list/abort multipart uploads
+	case uploadsCmd.FullCommand():
+		if len(*uploadsBucket) > 0 {
+			s3pal.Config.Aws.Bucket = *uploadsBucket
+		}
+
+		if *uploadsAction != "list" && *uploadsAction != "abort" {
+			fmt.Printf("\nUnknown action '%v'. Use list or abort.\n\n", *uploadsAction)
+			return
+		}
+
+		opts := abortOptions{Abort: *uploadsAction == "abort", UploadID: *uploadsID}
+		age, err := parseAge(*uploadsOlder)
+		if err != nil {
+			fmt.Printf("\nInvalid --older-than: %v\n\n", err)
+			return
+		}
+		opts.OlderThan = age
+
+		err = s3pal.listMultipartUploads(*uploadsPrefix, opts)
+		if err != nil {
+			fmt.Printf("Error listing uploads in bucket '%s': %v\n", s3pal.Config.Aws.Bucket, err)
+		}
+
 	// list
 	case listCmd.FullCommand():
 		if len(*listBucket) > 0 {
 			s3pal.Config.Aws.Bucket = *listBucket
 		}
 
-		items, err := s3pal.listS3Bucket(*listPrefix, *listUrls, *listSign, *listSignTTL)
+		delim := ""
+		if *listDirs {
+			delim = "/"
+		}
+
+		listing, err := s3pal.listDetailed(*listPrefix, delim, *listStartAfter, *listLimit, *listSign, *listSignTTL)
 
-		if err == nil {
-			for _, item := range items {
-				fmt.Println(item)
+		if err != nil {
+			fmt.Printf("Error listing bucket '%s': %v", s3pal.Config.Aws.Bucket, err)
+			return
+		}
+
+		switch {
+		case *listJSON:
+			err = printListJSON(os.Stdout, listing, *listDirs)
+		case *listCSV:
+			err = printListCSV(os.Stdout, listing)
+		case *listLong:
+			printListLong(os.Stdout, listing, *listUrls)
+		default:
+			for _, prefix := range listing.Prefixes {
+				fmt.Println(prefix)
+			}
+			for _, name := range listing.names(*listUrls) {
+				fmt.Println(name)
+			}
+		}
+
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		}
+
+		// keep JSON and CSV output parseable
+		out := os.Stdout
+		if *listJSON || *listCSV {
+			out = os.Stderr
+		} else if *listDirs {
+			fmt.Printf("\n%v Folders, %v Objects\n", len(listing.Prefixes), len(listing.Items))
+		} else {
+			fmt.Printf("\n%v Objects\n", len(listing.Items))
+		}
+
+		if len(listing.Next) > 0 {
+			fmt.Fprintf(out, "More objects after this, continue with: --start-after '%s'\n", listing.Next)
+		}
+
+	// get
+	case getCmd.FullCommand():
+		if len(*getBucket) > 0 {
+			s3pal.Config.Aws.Bucket = *getBucket
+		}
+
+		var err error
+		if *getIsRecursive {
+			dest := *getDest
+			if len(dest) == 0 {
+				dest = "."
 			}
-			fmt.Printf("\n%v Objects\n", len(items))
+
+			if dest == "-" {
+				fmt.Printf("\nCan not write more than one object to stdout.\n\n")
+				return
+			}
+
+			err = s3pal.getRecursive(*getKey, dest, *getConcurrency)
 		} else {
+			err = s3pal.getObject(*getKey, *getDest)
+		}
+
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "\nNot Downloaded! Error: %v\n\n", err)
+		}
+
+	// cp and mv
+	case cpCmd.FullCommand(), mvCmd.FullCommand():
+		move := parsed == mvCmd.FullCommand()
+		src, dst, headerArgs := *cpSrc, *cpDst, *cpHeaders
+		opts := copyOptions{ACL: *cpACL, Recursive: *cpRecursive, Move: move}
+		if move {
+			src, dst, headerArgs = *mvSrc, *mvDst, *mvHeaders
+			opts = copyOptions{ACL: *mvACL, Recursive: *mvRecursive, Move: move}
+		}
+
+		if len(opts.ACL) > 0 && !IsValidACL(opts.ACL) {
+			fmt.Printf("\n\"%v\" is not a valid ACL.\n", opts.ACL)
+			return
+		}
+
+		headers, err := parseHeaders(headerArgs)
+		if err != nil {
+			fmt.Printf("\n%v\n\n", err)
+			return
+		}
+		opts.SetHeaders = headers
+
+		err = s3pal.copyObjects(src, dst, opts)
+		if err != nil {
+			fmt.Printf("\nError: %v\n\n", err)
+		}
+
+	// sync
+	case syncCmd.FullCommand():
+		if *syncCompare != "md5" && *syncCompare != "mtime" {
+			fmt.Printf("\n--compare must be md5 or mtime\n\n")
+			return
+		}
+
+		opts := syncOptions{
+			Delete:      *syncDelete,
+			DryRun:      *syncDryRun,
+			Include:     *syncInclude,
+			Exclude:     *syncExclude,
+			Compare:     *syncCompare,
+			Concurrency: *syncConcurrency,
+			Manifest:    *syncManifest,
+		}
+
+		err := s3pal.syncCommand(*syncSrc, *syncDst, opts)
+		if err != nil {
+			fmt.Printf("\nError: %v\n\n", err)
+		}
+
+	// modify
+	case modifyCmd.FullCommand():
+		if len(*modifyBucket) > 0 {
+			s3pal.Config.Aws.Bucket = *modifyBucket
+		}
+
+		if len(*modifyACL) > 0 && !IsValidACL(*modifyACL) {
+			fmt.Printf("\n\"%v\" is not a valid ACL.\n", *modifyACL)
+			return
+		}
+
+		headers, err := parseHeaders(*modifyAddHeader)
+		if err != nil {
+			fmt.Printf("\n%v\n\n", err)
+			return
+		}
+
+		if len(headers) == 0 && len(*modifyRemoveHeader) == 0 && len(*modifyACL) == 0 {
+			fmt.Printf("\nNothing to modify. Use --add-header, --remove-header or --acl.\n\n")
+			return
+		}
+
+		opts := modifyOptions{
+			Prefix:        *modifyPrefix,
+			Match:         *modifyMatch,
+			AddHeaders:    headers,
+			RemoveHeaders: *modifyRemoveHeader,
+			ACL:           *modifyACL,
+			DryRun:        *modifyDryRun,
+			Concurrency:   *modifyConcurrency,
+			ProgressLog:   *modifyProgressLog,
+		}
+
+		err = s3pal.modifyObjects(opts)
+		if err != nil {
+			fmt.Printf("\nError: %v\n\n", err)
+		}
+
+	// rm
+	case rmCmd.FullCommand():
+		if len(*rmBucket) > 0 {
+			s3pal.Config.Aws.Bucket = *rmBucket
+		}
+
+		opts := rmOptions{
+			Prefix:       *rmPrefix,
+			Match:        *rmMatch,
+			DryRun:       *rmDryRun,
+			Yes:          *rmYes,
+			ConfirmAbove: *rmConfirmAbove,
+		}
+
+		if len(*rmOlderThan) > 0 {
+			age, err := parseAge(*rmOlderThan)
+			if err != nil {
+				fmt.Printf("\nInvalid --older-than: %v\n\n", err)
+				return
+			}
+			opts.OlderThan = age
+		}
+
+		if len(*rmKeys) == 0 && len(opts.Prefix) == 0 && len(opts.Match) == 0 && opts.OlderThan == 0 {
+			fmt.Printf("\nNothing to delete. Pass keys or --prefix, --older-than, --match.\n\n")
+			return
+		}
+
+		err := s3pal.removeObjects(*rmKeys, opts, os.Stdin, os.Stdout)
+		if err != nil {
+			fmt.Printf("\nError deleting from bucket '%s': %v\n\n", s3pal.Config.Aws.Bucket, err)
+		}
+
+	// kv
+	case kvCmd.FullCommand():
+		if len(*kvBucket) > 0 {
+			s3pal.Config.Aws.Bucket = *kvBucket
+		}
+
+		if *kvAction != "list" && len(*kvKey) == 0 {
+			fmt.Printf("\nMissing key. Use s3pal kv %v <key>\n\n", *kvAction)
+			return
+		}
+
+		var err error
+		switch *kvAction {
+		case "set":
+			var value []byte
+			if len(*kvValue) > 0 {
+				value = []byte(*kvValue)
+			} else if value, err = ioutil.ReadAll(os.Stdin); err != nil {
+				break
+			}
+
+			conditions := http.Header{}
+			if len(*kvIfMatch) > 0 {
+				conditions.Set("If-Match", *kvIfMatch)
+			}
+			if *kvCreate {
+				conditions.Set("If-None-Match", "*")
+			}
+
+			var etag string
+			etag, err = s3pal.kvSet(*kvKey, value, *kvType, conditions)
+			if err == nil {
+				fmt.Printf("Set %s (ETag %s)\n", *kvKey, etag)
+			}
+		case "get":
+			var value []byte
+			var info *ObjectInfo
+			value, info, err = s3pal.kvGet(*kvKey)
+			if err == nil {
+				os.Stdout.Write(value)
+				fmt.Fprintf(os.Stderr, "\nETag %s\n", info.ETag)
+			}
+		case "del":
+			err = s3pal.kvDelete(*kvKey, *kvIfMatch)
+			if err == nil {
+				fmt.Printf("Deleted %s\n", *kvKey)
+			}
+		case "list":
+			var keys []string
+			keys, err = s3pal.kvList(*kvKey)
+			for _, key := range keys {
+				fmt.Println(key)
+			}
+		default:
+			fmt.Printf("\nUnknown action '%v'. Use set, get, del or list.\n\n", *kvAction)
+			return
+		}
+
+		if err == ErrPreconditionFailed {
+			fmt.Fprintf(os.Stderr, "\nNothing done, '%s' does not match --if-match or --create.\n\n", *kvKey)
+		} else if err != nil {
+			fmt.Fprintf(os.Stderr, "\nError: %v\n\n", err)
+		}
+
+	// info
+	case infoCmd.FullCommand():
+		s3pal.printInfo(os.Stdout, *configPath)
+
+	// token
+	case tokenCmd.FullCommand():
+		token, err := s3pal.newAuthToken(*tokenName, *tokenPrefixes, *tokenOperations, time.Duration(*tokenTTL)*time.Second)
+		if err != nil {
+			fmt.Printf("\nNo token! %v\n\n", err)
+			return
+		}
+
+		fmt.Println(token)
+
+	// tree
+	case treeCmd.FullCommand():
+		if len(*treeBucket) > 0 {
+			s3pal.Config.Aws.Bucket = *treeBucket
+		}
+
+		err := s3pal.printTree(os.Stdout, *treePrefix, *treeFiles, *treeDepth)
+		if err != nil {
 			fmt.Printf("Error listing bucket '%s': %v", s3pal.Config.Aws.Bucket, err)
 		}
 
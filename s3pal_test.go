@@ -60,3 +60,11 @@ func TestWithUUID(t *testing.T) {
 	result := s3pal.makeFilename("", "table.jpg")
 	assert.Equal(t, len(result), 5+36)
 }
+
+func TestUploadNameRelativePath(t *testing.T) {
+	s3pal := getS3palWithFormat("mirror/%P/%F")
+
+	assert.Equal(t, "mirror/photos/2015/cat.jpg", s3pal.makeFilenameIn("", "photos/2015", "cat.jpg"))
+	assert.Equal(t, "mirror/cat.jpg", s3pal.makeFilenameIn("", "", "cat.jpg"))
+	assert.Equal(t, "mirror/cat.jpg", s3pal.makeFilename("", "cat.jpg"))
+}
@@ -0,0 +1,734 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// a whole request can not have a timeout, large parts and downloads take
+// long. A connection that makes no progress for s3IdleTimeout fails.
+const (
+	s3DialTimeout = 30 * time.Second
+	s3IdleTimeout = 2 * time.Minute
+)
+
+var s3Client = &http.Client{
+	Transport: &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		Dial:                  dialIdleTimeout,
+		TLSHandshakeTimeout:   s3DialTimeout,
+		ResponseHeaderTimeout: s3IdleTimeout,
+	},
+}
+
+// idleConn moves its deadline forward on every read and write
+type idleConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *idleConn) Read(b []byte) (int, error) {
+	c.Conn.SetDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Read(b)
+}
+
+func (c *idleConn) Write(b []byte) (int, error) {
+	c.Conn.SetDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Write(b)
+}
+
+func dialIdleTimeout(network string, addr string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: s3DialTimeout, KeepAlive: 30 * time.Second}
+	conn, err := dialer.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return &idleConn{Conn: conn, timeout: s3IdleTimeout}, nil
+}
+
+// s3Storage talks to the S3 REST API itself so every request and signed
+// URL uses Signature Version 4 (see sigv4.go), which all regions accept.
+type s3Storage struct {
+	config AwsConfig
+	creds  *awsCredentials
+	mu     sync.Mutex
+}
+
+func newS3Storage(config AwsConfig) *s3Storage {
+	creds, err := resolveCredentials(config)
+
+	if err != nil {
+		panic("Could not connect to S3: " + err.Error())
+	}
+
+	return &s3Storage{
+		config: config,
+		creds:  creds,
+	}
+}
+
+// s3ResponseError is the <Error> S3 answers failed requests with
+type s3ResponseError struct {
+	StatusCode int `xml:"-"`
+	Code       string
+	Message    string
+	RequestId  string
+}
+
+func (e *s3ResponseError) Error() string {
+	return fmt.Sprintf("%s: %s (%d)", e.Code, e.Message, e.StatusCode)
+}
+
+// s3Error turns the S3 errors callers check for into ErrNotFound and
+// ErrPreconditionFailed. S3 answers 409 when a conditional write races
+// another one.
+func s3Error(err error) error {
+	if s3err, ok := err.(*s3ResponseError); ok {
+		switch s3err.StatusCode {
+		case 404:
+			return ErrNotFound
+		case 409, 412:
+			return ErrPreconditionFailed
+		}
+	}
+
+	return err
+}
+
+// readS3Error reads the error of a failed request. HEAD responses have
+// no body, those only get the status.
+func readS3Error(resp *http.Response) error {
+	data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+
+	s3err := &s3ResponseError{}
+	xml.Unmarshal(data, s3err)
+
+	s3err.StatusCode = resp.StatusCode
+	if len(s3err.Code) == 0 {
+		s3err.Code = strings.Replace(http.StatusText(resp.StatusCode), " ", "", -1)
+	}
+
+	return s3err
+}
+
+// s3Endpoint splits the configured endpoint into scheme and host. A scheme
+// in the endpoint itself wins over disable_ssl. Without an endpoint it is
+// the AWS one of the region.
+func s3Endpoint(config AwsConfig) (string, string) {
+	scheme := "https"
+	if config.DisableSSL {
+		scheme = "http"
+	}
+
+	host := config.Endpoint
+	if len(host) == 0 {
+		return scheme, awsS3Host(config.Region)
+	}
+
+	if i := strings.Index(host, "://"); i >= 0 {
+		scheme = host[:i]
+		host = host[i+3:]
+	}
+
+	return scheme, strings.TrimRight(host, "/")
+}
+
+func awsS3Host(region string) string {
+	switch {
+	case len(region) == 0 || region == "us-east-1":
+		return "s3.amazonaws.com"
+	case strings.HasPrefix(region, "cn-"):
+		return "s3." + region + ".amazonaws.com.cn"
+	}
+
+	return "s3." + region + ".amazonaws.com"
+}
+
+// s3SigningRegion defaults to us-east-1, which S3 clones like MinIO use
+// too.
+func s3SigningRegion(config AwsConfig) string {
+	if len(config.Region) == 0 {
+		return "us-east-1"
+	}
+
+	return config.Region
+}
+
+// pathStyle puts the bucket in the path instead of the host name. AWS
+// certificates do not cover bucket names with dots as sub domains.
+func (s *s3Storage) pathStyle() bool {
+	return s.config.PathStyle || (len(s.config.Endpoint) == 0 && strings.Contains(s.config.Bucket, "."))
+}
+
+// objectURL is the URL of key, or of the bucket for an empty key
+func (s *s3Storage) objectURL(key string) *url.URL {
+	scheme, host := s3Endpoint(s.config)
+	u := &url.URL{Scheme: scheme, Host: host, Path: "/" + key}
+
+	if s.pathStyle() {
+		u.Path = "/" + s.config.Bucket
+		if len(key) > 0 {
+			u.Path += "/" + key
+		}
+	} else {
+		u.Host = s.config.Bucket + "." + host
+	}
+
+	return u
+}
+
+// credentials are resolved again shortly before they expire
+func (s *s3Storage) credentials() (*awsCredentials, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.creds.Expires.IsZero() && time.Now().Add(time.Minute).After(s.creds.Expires) {
+		creds, err := resolveCredentials(s.config)
+		if err != nil {
+			return nil, err
+		}
+		s.creds = creds
+	}
+
+	return s.creds, nil
+}
+
+func (s *s3Storage) signer() (sigV4, error) {
+	creds, err := s.credentials()
+	if err != nil {
+		return sigV4{}, err
+	}
+
+	return sigV4{
+		AccessKey: creds.AccessKey,
+		SecretKey: creds.SecretKey,
+		Token:     creds.Token,
+		Region:    s3SigningRegion(s.config),
+		Service:   "s3",
+	}, nil
+}
+
+// do sends a signed request for key (the bucket when empty). Responses
+// other than 2xx are returned as *s3ResponseError. payloadHash is the
+// SHA256 of body or unsignedPayload for streamed bodies.
+func (s *s3Storage) do(method string, key string, query url.Values, headers http.Header, body io.Reader, size int64, payloadHash string) (*http.Response, error) {
+	signer, err := s.signer()
+	if err != nil {
+		return nil, err
+	}
+
+	u := s.objectURL(key)
+	u.RawQuery = canonicalQuery(query)
+
+	req := &http.Request{
+		Method: method,
+		URL:    u,
+		Host:   u.Host,
+		Header: http.Header{},
+	}
+
+	for name, values := range headers {
+		req.Header[http.CanonicalHeaderKey(name)] = values
+	}
+
+	// without a body Go sends Content-Length: 0, with one and no length
+	// it would be chunked, which S3 does not take
+	if body != nil && size > 0 {
+		req.Body = ioutil.NopCloser(body)
+		req.ContentLength = size
+	}
+
+	signer.sign(req, payloadHash, time.Now())
+	setCanonicalURL(req)
+
+	resp, err := s3Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		return nil, readS3Error(resp)
+	}
+
+	return resp, nil
+}
+
+// doXML sends body as XML (signed with its hash) and decodes the response
+// into result when it is not nil. S3 can answer 200 with an <Error> for
+// copies and completing multipart uploads.
+func (s *s3Storage) doXML(method string, key string, query url.Values, headers http.Header, body []byte, result interface{}) error {
+	if headers == nil {
+		headers = http.Header{}
+	}
+
+	if len(body) > 0 {
+		sum := md5.Sum(body)
+		headers.Set("Content-MD5", base64.StdEncoding.EncodeToString(sum[:]))
+		headers.Set("Content-Type", "application/xml")
+	}
+
+	resp, err := s.do(method, key, query, headers, bytes.NewReader(body), int64(len(body)), sha256Hex(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	var root struct {
+		XMLName xml.Name
+	}
+	xml.Unmarshal(data, &root)
+
+	if root.XMLName.Local == "Error" {
+		s3err := &s3ResponseError{StatusCode: resp.StatusCode}
+		xml.Unmarshal(data, s3err)
+		return s3err
+	}
+
+	if result == nil || len(data) == 0 {
+		return nil
+	}
+
+	return xml.Unmarshal(data, result)
+}
+
+func withACL(headers http.Header, acl string) http.Header {
+	result := http.Header{}
+	for name, values := range headers {
+		result[name] = values
+	}
+
+	if len(acl) > 0 {
+		result.Set("X-Amz-Acl", acl)
+	}
+
+	return result
+}
+
+func (s *s3Storage) Put(key string, r io.Reader, size int64, headers http.Header, acl string) (string, error) {
+	resp, err := s.do("PUT", key, nil, withACL(headers, acl), r, size, unsignedPayload)
+	if err != nil {
+		return "", s3Error(err)
+	}
+
+	resp.Body.Close()
+	return resp.Header.Get("ETag"), nil
+}
+
+func (s *s3Storage) Get(key string) (io.ReadCloser, error) {
+	resp, err := s.do("GET", key, nil, nil, nil, 0, sha256Hex(nil))
+	if err != nil {
+		return nil, s3Error(err)
+	}
+
+	return resp.Body, nil
+}
+
+type s3ListBucketResult struct {
+	IsTruncated bool
+	NextMarker  string
+	Contents    []struct {
+		Key          string
+		LastModified string
+		ETag         string
+		Size         int64
+		StorageClass string
+	}
+	CommonPrefixes []struct {
+		Prefix string
+	}
+}
+
+func (s *s3Storage) List(prefix, delim, marker string, max int) (*ListResult, error) {
+	query := url.Values{}
+	query.Set("prefix", prefix)
+	if len(delim) > 0 {
+		query.Set("delimiter", delim)
+	}
+	if len(marker) > 0 {
+		query.Set("marker", marker)
+	}
+	if max > 0 {
+		query.Set("max-keys", strconv.Itoa(max))
+	}
+
+	var resp s3ListBucketResult
+	if err := s.doXML("GET", "", query, nil, nil, &resp); err != nil {
+		return nil, err
+	}
+
+	result := &ListResult{
+		IsTruncated: resp.IsTruncated,
+		NextMarker:  resp.NextMarker,
+	}
+
+	for _, commonPrefix := range resp.CommonPrefixes {
+		result.CommonPrefixes = append(result.CommonPrefixes, commonPrefix.Prefix)
+	}
+
+	for _, key := range resp.Contents {
+		lastModified, _ := time.Parse(time.RFC3339Nano, key.LastModified)
+		result.Objects = append(result.Objects, ObjectInfo{
+			Key:          key.Key,
+			Size:         key.Size,
+			LastModified: lastModified,
+			ETag:         key.ETag,
+			StorageClass: key.StorageClass,
+		})
+	}
+
+	// S3 only sends NextMarker when a delimiter is used
+	if result.IsTruncated && len(result.NextMarker) == 0 && len(result.Objects) > 0 {
+		result.NextMarker = result.Objects[len(result.Objects)-1].Key
+	}
+
+	return result, nil
+}
+
+func (s *s3Storage) Delete(key string) error {
+	resp, err := s.do("DELETE", key, nil, nil, nil, 0, sha256Hex(nil))
+	if err != nil {
+		return s3Error(err)
+	}
+
+	resp.Body.Close()
+	return nil
+}
+
+type s3DeleteRequest struct {
+	XMLName xml.Name `xml:"Delete"`
+	Quiet   bool
+	Objects []s3DeleteObject `xml:"Object"`
+}
+
+type s3DeleteObject struct {
+	Key string
+}
+
+type s3DeleteResult struct {
+	Errors []struct {
+		Key     string
+		Code    string
+		Message string
+	} `xml:"Error"`
+}
+
+// DeleteMulti deletes keys in one quiet request, the response only lists
+// the keys that were not deleted
+func (s *s3Storage) DeleteMulti(keys []string) (map[string]error, error) {
+	request := s3DeleteRequest{Quiet: true}
+	for _, key := range keys {
+		request.Objects = append(request.Objects, s3DeleteObject{Key: key})
+	}
+
+	body, err := xml.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+
+	var result s3DeleteResult
+	if err = s.doXML("POST", "", url.Values{"delete": {""}}, nil, body, &result); err != nil {
+		return nil, err
+	}
+
+	failed := map[string]error{}
+	for _, e := range result.Errors {
+		failed[e.Key] = fmt.Errorf("%s %s", e.Code, e.Message)
+	}
+
+	return failed, nil
+}
+
+func (s *s3Storage) Copy(srcBucket string, srcKey string, key string, headers http.Header, acl string) error {
+	directive := "COPY"
+	if headers != nil {
+		directive = "REPLACE"
+	}
+
+	headers = withACL(headers, acl)
+	headers.Set("X-Amz-Copy-Source", "/"+srcBucket+"/"+sigV4Escape(srcKey, true))
+	headers.Set("X-Amz-Metadata-Directive", directive)
+
+	return s.doXML("PUT", key, nil, headers, nil, nil)
+}
+
+// GetACL returns the AccessControlPolicy XML of key
+func (s *s3Storage) GetACL(key string) ([]byte, error) {
+	resp, err := s.do("GET", key, url.Values{"acl": {""}}, nil, nil, 0, sha256Hex(nil))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	return ioutil.ReadAll(resp.Body)
+}
+
+func (s *s3Storage) PutACL(key string, acl []byte) error {
+	return s.doXML("PUT", key, url.Values{"acl": {""}}, nil, acl, nil)
+}
+
+func (s *s3Storage) Head(key string) (*ObjectInfo, error) {
+	resp, err := s.do("HEAD", key, nil, nil, nil, 0, sha256Hex(nil))
+	if err != nil {
+		return nil, s3Error(err)
+	}
+	resp.Body.Close()
+
+	size, _ := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
+	lastModified, _ := time.Parse(http.TimeFormat, resp.Header.Get("Last-Modified"))
+
+	return &ObjectInfo{
+		Key:          key,
+		Size:         size,
+		LastModified: lastModified,
+		ETag:         resp.Header.Get("ETag"),
+		StorageClass: resp.Header.Get("x-amz-storage-class"),
+		ContentType:  resp.Header.Get("Content-Type"),
+		Headers:      resp.Header,
+	}, nil
+}
+
+func (s *s3Storage) InitMultipart(key string, headers http.Header, acl string) (string, error) {
+	var result struct {
+		UploadId string
+	}
+
+	err := s.doXML("POST", key, url.Values{"uploads": {""}}, withACL(headers, acl), nil, &result)
+	return result.UploadId, err
+}
+
+func (s *s3Storage) PutPart(key string, uploadID string, n int, r io.ReadSeeker) (UploadPart, error) {
+	size, err := r.Seek(0, os.SEEK_END)
+	if err != nil {
+		return UploadPart{}, err
+	}
+
+	if _, err = r.Seek(0, os.SEEK_SET); err != nil {
+		return UploadPart{}, err
+	}
+
+	query := url.Values{}
+	query.Set("partNumber", strconv.Itoa(n))
+	query.Set("uploadId", uploadID)
+
+	resp, err := s.do("PUT", key, query, nil, r, size, unsignedPayload)
+	if err != nil {
+		return UploadPart{}, err
+	}
+	resp.Body.Close()
+
+	return UploadPart{N: n, ETag: resp.Header.Get("ETag"), Size: size}, nil
+}
+
+type s3CompleteRequest struct {
+	XMLName xml.Name         `xml:"CompleteMultipartUpload"`
+	Parts   []s3CompletePart `xml:"Part"`
+}
+
+type s3CompletePart struct {
+	PartNumber int
+	ETag       string
+}
+
+type completePartsByNumber []s3CompletePart
+
+func (p completePartsByNumber) Len() int           { return len(p) }
+func (p completePartsByNumber) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+func (p completePartsByNumber) Less(i, j int) bool { return p[i].PartNumber < p[j].PartNumber }
+
+func (s *s3Storage) CompleteMultipart(key string, uploadID string, parts []UploadPart) error {
+	request := s3CompleteRequest{}
+	for _, part := range parts {
+		request.Parts = append(request.Parts, s3CompletePart{PartNumber: part.N, ETag: part.ETag})
+	}
+	sort.Sort(completePartsByNumber(request.Parts))
+
+	body, err := xml.Marshal(request)
+	if err != nil {
+		return err
+	}
+
+	return s.doXML("POST", key, url.Values{"uploadId": {uploadID}}, nil, body, nil)
+}
+
+func (s *s3Storage) AbortMultipart(key string, uploadID string) error {
+	resp, err := s.do("DELETE", key, url.Values{"uploadId": {uploadID}}, nil, nil, 0, sha256Hex(nil))
+	if err != nil {
+		return err
+	}
+
+	resp.Body.Close()
+	return nil
+}
+
+type s3ListMultipartResult struct {
+	IsTruncated        bool
+	NextKeyMarker      string
+	NextUploadIdMarker string
+	Uploads            []struct {
+		Key       string
+		UploadId  string
+		Initiated time.Time
+	} `xml:"Upload"`
+}
+
+func (s *s3Storage) ListMultipart(prefix string) ([]MultipartUpload, error) {
+	query := url.Values{}
+	query.Set("uploads", "")
+	query.Set("prefix", prefix)
+
+	var uploads []MultipartUpload
+	for {
+		var resp s3ListMultipartResult
+		if err := s.doXML("GET", "", query, nil, nil, &resp); err != nil {
+			return nil, err
+		}
+
+		for _, upload := range resp.Uploads {
+			uploads = append(uploads, MultipartUpload{Key: upload.Key, UploadID: upload.UploadId, Initiated: upload.Initiated})
+		}
+
+		if !resp.IsTruncated {
+			return uploads, nil
+		}
+
+		query.Set("key-marker", resp.NextKeyMarker)
+		query.Set("upload-id-marker", resp.NextUploadIdMarker)
+	}
+}
+
+func (s *s3Storage) URL(key string) string {
+	u := s.objectURL(key)
+	return u.Scheme + "://" + u.Host + canonicalPath(u)
+}
+
+// SignedURL is a SigV4 presigned GET URL. Presigned URLs are valid for at
+// most a week, later expires are cut to that.
+func (s *s3Storage) SignedURL(key string, expires time.Time) string {
+	signer, err := s.signer()
+	if err != nil {
+		return s.URL(key)
+	}
+
+	req := &http.Request{
+		Method: "GET",
+		URL:    s.objectURL(key),
+		Header: http.Header{},
+	}
+
+	now := time.Now()
+	return signer.presign(req, expires.Sub(now), now)
+}
+
+// PresignPut signs the headers of the policy (and the size if set) so S3
+// rejects uploads that differ.
+func (s *s3Storage) PresignPut(p uploadPolicy) (string, error) {
+	signer, err := s.signer()
+	if err != nil {
+		return "", err
+	}
+
+	req := &http.Request{
+		Method: "PUT",
+		URL:    s.objectURL(p.Key),
+		Header: http.Header{},
+	}
+
+	for name, values := range p.Headers {
+		req.Header[http.CanonicalHeaderKey(name)] = values
+	}
+
+	if p.Size > 0 {
+		req.Header.Set("Content-Length", strconv.FormatInt(p.Size, 10))
+	}
+
+	if len(p.ACL) > 0 {
+		req.URL.RawQuery = "x-amz-acl=" + sigV4Escape(p.ACL, false)
+	}
+
+	now := time.Now()
+	return signer.presign(req, p.Expires.Sub(now), now), nil
+}
+
+// PresignPost builds a SigV4 POST policy, see
+// http://docs.aws.amazon.com/AmazonS3/latest/API/sigv4-post-example.html
+// Every field is an exact match condition, the size is limited with
+// content-length-range.
+func (s *s3Storage) PresignPost(p uploadPolicy) (string, map[string]string, error) {
+	signer, err := s.signer()
+	if err != nil {
+		return "", nil, err
+	}
+
+	now := time.Now().UTC()
+
+	fields := map[string]string{
+		"key":                   p.Key,
+		"success_action_status": "201",
+		"x-amz-algorithm":       sigV4Algorithm,
+		"x-amz-credential":      signer.AccessKey + "/" + signer.scope(now),
+		"x-amz-date":            now.Format(sigV4TimeFormat),
+	}
+
+	if len(p.ACL) > 0 {
+		fields["acl"] = p.ACL
+	}
+
+	if len(signer.Token) > 0 {
+		fields["x-amz-security-token"] = signer.Token
+	}
+
+	for name := range p.Headers {
+		fields[name] = p.Headers.Get(name)
+	}
+
+	var names []string
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	conditions := []interface{}{map[string]string{"bucket": s.config.Bucket}}
+	for _, name := range names {
+		conditions = append(conditions, map[string]string{name: fields[name]})
+	}
+
+	if p.MaxSize > 0 {
+		conditions = append(conditions, []interface{}{"content-length-range", 0, p.MaxSize})
+	}
+
+	policy, err := json.Marshal(map[string]interface{}{
+		"expiration": p.Expires.UTC().Format("2006-01-02T15:04:05.000Z"),
+		"conditions": conditions,
+	})
+	if err != nil {
+		return "", nil, err
+	}
+
+	encoded := base64.StdEncoding.EncodeToString(policy)
+	fields["policy"] = encoded
+	fields["x-amz-signature"] = signer.signature(now, encoded)
+
+	return s.URL(""), fields, nil
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestS3URLCustomEndpoint(t *testing.T) {
+	config := AwsConfig{
+		Bucket:     "mybucket",
+		Endpoint:   "localhost:9000",
+		PathStyle:  true,
+		DisableSSL: true,
+	}
+	storage := &s3Storage{config: config}
+	assert.Equal(t, "http://localhost:9000/mybucket/cat.jpg", storage.URL("cat.jpg"))
+
+	storage.config.PathStyle = false
+	storage.config.Endpoint = "https://s3.example.com/"
+	assert.Equal(t, "https://mybucket.s3.example.com/cat.jpg", storage.URL("cat.jpg"))
+}
+
+func TestS3URLRegions(t *testing.T) {
+	storage := &s3Storage{config: AwsConfig{Bucket: "mybucket", Region: "eu-central-1"}}
+	assert.Equal(t, "https://mybucket.s3.eu-central-1.amazonaws.com/my%20cat.jpg", storage.URL("my cat.jpg"))
+
+	storage.config.Region = ""
+	assert.Equal(t, "https://mybucket.s3.amazonaws.com/cat.jpg", storage.URL("cat.jpg"))
+
+	// no sub domains for buckets with dots
+	storage.config.Bucket = "assets.example.com"
+	storage.config.Region = "cn-north-1"
+	assert.Equal(t, "https://s3.cn-north-1.amazonaws.com.cn/assets.example.com/cat.jpg", storage.URL("cat.jpg"))
+}
+
+func TestS3SignedURL(t *testing.T) {
+	storage := &s3Storage{
+		config: AwsConfig{Bucket: "mybucket", Region: "ap-east-1"},
+		creds:  &awsCredentials{AccessKey: "AKID", SecretKey: "secret", Token: "session"},
+	}
+
+	signed := storage.SignedURL("cat.jpg", time.Now().Add(time.Hour))
+	assert.True(t, strings.HasPrefix(signed, "https://mybucket.s3.ap-east-1.amazonaws.com/cat.jpg?X-Amz-Algorithm=AWS4-HMAC-SHA256&X-Amz-Credential=AKID%2F"))
+	assert.Contains(t, signed, "%2Fap-east-1%2Fs3%2Faws4_request")
+	assert.Contains(t, signed, "&X-Amz-Expires=3600&X-Amz-Security-Token=session&")
+	assert.Contains(t, signed, "&X-Amz-Signature=")
+}
+
+// fakeS3 serves a path style bucket from a map and rejects requests whose
+// signature does not match what was sent
+type fakeS3 struct {
+	objects map[string][]byte
+	headers map[string]http.Header
+}
+
+func (f *fakeS3) checkSignature(r *http.Request) bool {
+	signedAt, _ := time.Parse(sigV4TimeFormat, r.Header.Get("X-Amz-Date"))
+
+	req, _ := http.NewRequest(r.Method, "http://"+r.Host+r.URL.Path+"?"+r.URL.RawQuery, nil)
+	for name, values := range r.Header {
+		if name != "Authorization" && name != "X-Amz-Date" && name != "X-Amz-Content-Sha256" {
+			req.Header[name] = values
+		}
+	}
+
+	signer := sigV4{AccessKey: "AKID", SecretKey: "secret", Region: "us-east-1", Service: "s3"}
+	signer.sign(req, r.Header.Get("X-Amz-Content-Sha256"), signedAt)
+
+	return req.Header.Get("Authorization") == r.Header.Get("Authorization")
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !f.checkSignature(r) {
+		w.WriteHeader(403)
+		fmt.Fprint(w, "<Error><Code>SignatureDoesNotMatch</Code><Message>bad signature</Message></Error>")
+		return
+	}
+
+	key := strings.TrimPrefix(r.URL.Path, "/mybucket/")
+
+	switch {
+	case r.Method == "POST" && r.URL.RawQuery == "uploads=":
+		f.headers[key] = r.Header
+		fmt.Fprint(w, "<InitiateMultipartUploadResult><UploadId>upload-1</UploadId></InitiateMultipartUploadResult>")
+	case r.Method == "POST" && r.URL.RawQuery == "delete=":
+		var request s3DeleteRequest
+		data, _ := ioutil.ReadAll(r.Body)
+		xml.Unmarshal(data, &request)
+
+		fmt.Fprint(w, "<DeleteResult>")
+		for _, object := range request.Objects {
+			if strings.HasPrefix(object.Key, "locked/") {
+				fmt.Fprintf(w, "<Error><Key>%s</Key><Code>AccessDenied</Code><Message>Access Denied</Message></Error>", object.Key)
+				continue
+			}
+			delete(f.objects, object.Key)
+		}
+		fmt.Fprint(w, "</DeleteResult>")
+	case r.Method == "PUT":
+		data, _ := ioutil.ReadAll(r.Body)
+		f.objects[key] = data
+		f.headers[key] = r.Header
+		w.Header().Set("ETag", `"etag"`)
+	case r.Method == "GET" && r.URL.Path == "/mybucket":
+		var keys []string
+		for k := range f.objects {
+			if strings.HasPrefix(k, r.URL.Query().Get("prefix")) {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+
+		result := struct {
+			XMLName  xml.Name `xml:"ListBucketResult"`
+			Contents []struct {
+				Key  string
+				Size int
+			}
+		}{}
+		for _, k := range keys {
+			result.Contents = append(result.Contents, struct {
+				Key  string
+				Size int
+			}{k, len(f.objects[k])})
+		}
+		xml.NewEncoder(w).Encode(result)
+	case r.Method == "GET" || r.Method == "HEAD":
+		data, ok := f.objects[key]
+		if !ok {
+			w.WriteHeader(404)
+			if r.Method == "GET" {
+				fmt.Fprint(w, "<Error><Code>NoSuchKey</Code><Message>The specified key does not exist.</Message></Error>")
+			}
+			return
+		}
+		w.Header().Set("Content-Type", f.headers[key].Get("Content-Type"))
+		w.Write(data)
+	case r.Method == "DELETE":
+		delete(f.objects, key)
+		w.WriteHeader(204)
+	}
+}
+
+func TestS3StorageRequests(t *testing.T) {
+	fake := &fakeS3{objects: map[string][]byte{}, headers: map[string]http.Header{}}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	storage := &s3Storage{
+		config: AwsConfig{Bucket: "mybucket", Endpoint: server.URL, PathStyle: true},
+		creds:  &awsCredentials{AccessKey: "AKID", SecretKey: "secret"},
+	}
+
+	// keys with characters Go and S3 escape differently
+	key := "uploads/my cat+($1).txt"
+	headers := http.Header{"Content-Type": []string{"text/plain"}}
+	etag, err := storage.Put(key, strings.NewReader("meow"), 4, headers, "private")
+	assert.Nil(t, err)
+	assert.Equal(t, `"etag"`, etag)
+	assert.Equal(t, "private", fake.headers[key].Get("X-Amz-Acl"))
+	assert.Equal(t, unsignedPayload, fake.headers[key].Get("X-Amz-Content-Sha256"))
+
+	_, err = storage.Put("empty.txt", strings.NewReader(""), 0, nil, "")
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{}, fake.objects["empty.txt"])
+
+	rc, err := storage.Get(key)
+	assert.Nil(t, err)
+	data, _ := ioutil.ReadAll(rc)
+	rc.Close()
+	assert.Equal(t, "meow", string(data))
+
+	info, err := storage.Head(key)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(4), info.Size)
+	assert.Equal(t, "text/plain", info.ContentType)
+
+	result, err := storage.List("uploads/", "", "", 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(result.Objects))
+	assert.Equal(t, key, result.Objects[0].Key)
+
+	assert.Nil(t, storage.Delete(key))
+
+	_, err = storage.Head(key)
+	assert.Equal(t, ErrNotFound, err)
+	_, err = storage.Get(key)
+	assert.Equal(t, ErrNotFound, err)
+
+	storage.creds = &awsCredentials{AccessKey: "AKID", SecretKey: "wrong"}
+	_, err = storage.Put("cat.txt", strings.NewReader("meow"), 4, nil, "")
+	assert.Contains(t, err.Error(), "SignatureDoesNotMatch")
+}
+
+func TestS3StorageInitMultipartHeaders(t *testing.T) {
+	fake := &fakeS3{objects: map[string][]byte{}, headers: map[string]http.Header{}}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	storage := &s3Storage{
+		config: AwsConfig{Bucket: "mybucket", Endpoint: server.URL, PathStyle: true},
+		creds:  &awsCredentials{AccessKey: "AKID", SecretKey: "secret"},
+	}
+
+	// multipart uploads keep aws.upload_headers like single PUTs do
+	headers := http.Header{
+		"Content-Type":        []string{"video/mp4"},
+		"Cache-Control":       []string{"max-age=60"},
+		"Content-Disposition": []string{"attachment"},
+	}
+	uploadID, err := storage.InitMultipart("big.mp4", headers, "private")
+	assert.Nil(t, err)
+	assert.Equal(t, "upload-1", uploadID)
+
+	sent := fake.headers["big.mp4"]
+	assert.Equal(t, "video/mp4", sent.Get("Content-Type"))
+	assert.Equal(t, "max-age=60", sent.Get("Cache-Control"))
+	assert.Equal(t, "attachment", sent.Get("Content-Disposition"))
+	assert.Equal(t, "private", sent.Get("X-Amz-Acl"))
+}
+
+func TestIdleConnTimesOut(t *testing.T) {
+	stall := make(chan bool)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("part"))
+		w.(http.Flusher).Flush()
+		<-stall
+	}))
+	defer server.Close()
+	defer close(stall)
+
+	client := &http.Client{Transport: &http.Transport{
+		Dial: func(network string, addr string) (net.Conn, error) {
+			conn, err := net.Dial(network, addr)
+			if err != nil {
+				return nil, err
+			}
+			return &idleConn{Conn: conn, timeout: 100 * time.Millisecond}, nil
+		},
+	}}
+
+	resp, err := client.Get(server.URL)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+
+	start := time.Now()
+	_, err = ioutil.ReadAll(resp.Body)
+	assert.NotNil(t, err)
+	assert.True(t, time.Since(start) < 5*time.Second)
+}
+
+func TestS3StorageDeleteMultiPartly(t *testing.T) {
+	fake := &fakeS3{objects: map[string][]byte{}, headers: map[string]http.Header{}}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	storage := &s3Storage{
+		config: AwsConfig{Bucket: "mybucket", Endpoint: server.URL, PathStyle: true},
+		creds:  &awsCredentials{AccessKey: "AKID", SecretKey: "secret"},
+	}
+	for _, key := range []string{"a.txt", "locked/b.txt", "c.txt"} {
+		fake.objects[key] = []byte("x")
+	}
+
+	var out bytes.Buffer
+	s3pal := getS3palWithStorage(storage)
+	deleted, err := s3pal.deleteKeys([]string{"a.txt", "locked/b.txt", "c.txt"}, &out)
+	assert.Equal(t, 2, deleted)
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "locked/b.txt: AccessDenied")
+	}
+	assert.Equal(t, "Deleted a.txt\nDeleted c.txt\n", out.String())
+	assert.Equal(t, map[string][]byte{"locked/b.txt": []byte("x")}, fake.objects)
+}
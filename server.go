@@ -8,7 +8,9 @@ import (
 	"io/ioutil"
 	"log"
 	"net"
+	"net/http"
 	"os"
+	"path"
 	"strconv"
 	"strings"
 	"time"
@@ -44,8 +46,9 @@ func (s *S3pal) CORSMiddleware() gin.HandlerFunc {
 
 		c.Writer.Header().Set("Access-Control-Allow-Origin", origin)
 		c.Writer.Header().Set("Access-Control-Allow-Credentials", "true")
-		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, accept, origin, Cache-Control, X-Requested-With")
-		c.Writer.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS, GET, PUT")
+		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, accept, origin, Cache-Control, X-Requested-With, If-Match, If-None-Match, X-Api-Key")
+		c.Writer.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS, GET, PUT, DELETE")
+		c.Writer.Header().Set("Access-Control-Expose-Headers", "ETag")
 
 		if c.Request.Method == "OPTIONS" {
 			c.AbortWithStatus(204)
@@ -56,6 +59,363 @@ func (s *S3pal) CORSMiddleware() gin.HandlerFunc {
 	}
 }
 
+func listCacheKey(prefix string, query string) string {
+	return prefix + "\n" + query
+}
+
+func (l *ListCache) get(key string) (interface{}, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if time.Now().Unix() > l.timeout[key] {
+		return nil, false
+	}
+
+	return l.items[key], true
+}
+
+func (l *ListCache) set(key string, response interface{}, ttl int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.items[key] = response
+	l.timeout[key] = time.Now().Unix() + ttl
+}
+
+// bust expires every cached listing of prefix
+func (l *ListCache) bust(prefix string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for key := range l.timeout {
+		if strings.HasPrefix(key, listCacheKey(prefix, "")) {
+			l.timeout[key] = 0
+		}
+	}
+}
+
+// cursors for /list are the marker to continue from, opaque to clients
+func encodeCursor(marker string) string {
+	if len(marker) == 0 {
+		return ""
+	}
+
+	return base64.URLEncoding.EncodeToString([]byte(marker))
+}
+
+func decodeCursor(cursor string) (string, error) {
+	marker, err := base64.URLEncoding.DecodeString(cursor)
+	return string(marker), err
+}
+
+func (s *S3pal) serveStoredFile(c *gin.Context) {
+	key := strings.TrimPrefix(c.Params.ByName("key"), "/")
+	storage := s.getStorage()
+
+	info, err := storage.Head(key)
+	if err != nil {
+		response := map[string]string{
+			"status": "error",
+			"reason": "not found",
+		}
+		c.JSON(404, response)
+		return
+	}
+
+	rc, err := storage.Get(key)
+	if err != nil {
+		response := map[string]string{
+			"status": "error",
+			"reason": "error reading",
+		}
+		c.JSON(500, response)
+		return
+	}
+	defer rc.Close()
+
+	for name, values := range info.Headers {
+		c.Writer.Header()[name] = values
+	}
+
+	c.Writer.Header().Set("Content-Length", strconv.FormatInt(info.Size, 10))
+	c.Writer.Header().Set("Last-Modified", info.LastModified.Format(http.TimeFormat))
+	if len(info.ETag) > 0 {
+		c.Writer.Header().Set("ETag", info.ETag)
+	}
+
+	c.Writer.WriteHeader(200)
+	io.Copy(c.Writer, rc)
+}
+
+// maxPostBytes is the configured limit, 4MB if not set. Negative means
+// any size.
+func (s *S3pal) maxPostBytes() int64 {
+	max := s.Config.Server.MaxPostBytes
+	if max == 0 {
+		max = 4000000
+	}
+
+	return max
+}
+
+// room for the multipart boundaries and form fields around an uploaded
+// file, which max_post_bytes does not count
+const maxPostOverhead = 64 * 1024
+
+// limitedBody is a request body cut off by http.MaxBytesReader, it
+// remembers whether it was cut off
+type limitedBody struct {
+	io.ReadCloser
+	read  int64
+	limit int64
+	err   error
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.read += int64(n)
+	if err != nil && err != io.EOF {
+		b.err = err
+	}
+
+	return n, err
+}
+
+func (b *limitedBody) exceeded() bool {
+	return b.err != nil && b.read >= b.limit
+}
+
+// bodyTooBig is true when reading the request body failed because it was
+// bigger than the server takes
+func bodyTooBig(r *http.Request) bool {
+	body, ok := r.Body.(*limitedBody)
+	return ok && body.exceeded()
+}
+
+func (s *S3pal) tooBigResponse(c *gin.Context) {
+	response := map[string]string{
+		"status": "error",
+		"reason": fmt.Sprintf("Upload too big. > %v", s.maxPostBytes()),
+	}
+	c.JSON(413, response)
+}
+
+// MaxBodyMiddleware enforces max_post_bytes before anything is written to
+// disk: requests with a bigger Content-Length are rejected right away and
+// bodies without one (chunked) stop being read once they get too big.
+func (s *S3pal) MaxBodyMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		max := s.maxPostBytes()
+		if max < 0 || c.Request.Body == nil {
+			c.Next()
+			return
+		}
+
+		limit := max + maxPostOverhead
+		if c.Request.ContentLength > limit {
+			s.tooBigResponse(c)
+			c.Abort()
+			return
+		}
+
+		c.Request.Body = &limitedBody{
+			ReadCloser: http.MaxBytesReader(c.Writer, c.Request.Body, limit),
+			limit:      limit,
+		}
+
+		c.Next()
+	}
+}
+
+func serverSource(c *gin.Context) eventSource {
+	return eventSource{Name: "server", ClientIP: c.ClientIP()}
+}
+
+func kvError(c *gin.Context, err error) {
+	code := 500
+	switch {
+	case err == ErrNotFound:
+		code = 404
+	case err == ErrPreconditionFailed:
+		code = 412
+	case err == ErrInvalidKey:
+		code = 400
+	}
+
+	response := map[string]string{
+		"status": "error",
+		"reason": err.Error(),
+	}
+	c.JSON(code, response)
+}
+
+// kvGetHandler returns the value of a key with its ETag, or the keys under
+// a prefix ending in / as a list
+func (s *S3pal) kvGetHandler(c *gin.Context) {
+	key := strings.TrimPrefix(c.Params.ByName("key"), "/")
+
+	if len(key) == 0 || strings.HasSuffix(key, "/") {
+		keys, err := s.kvList(key)
+		if err != nil {
+			kvError(c, err)
+			return
+		}
+
+		c.JSON(200, keys)
+		return
+	}
+
+	value, info, err := s.kvGet(key)
+	if err != nil {
+		kvError(c, err)
+		return
+	}
+
+	c.Writer.Header().Set("Content-Type", info.ContentType)
+	c.Writer.Header().Set("Content-Length", strconv.Itoa(len(value)))
+	c.Writer.Header().Set("ETag", info.ETag)
+	c.Writer.WriteHeader(200)
+	c.Writer.Write(value)
+}
+
+// kvPutHandler sets a key to the request body. If-Match and
+// If-None-Match: * make it conditional, 412 when they fail.
+func (s *S3pal) kvPutHandler(c *gin.Context) {
+	key := strings.TrimPrefix(c.Params.ByName("key"), "/")
+
+	body := io.Reader(c.Request.Body)
+	max := s.maxPostBytes()
+	if max > 0 {
+		body = io.LimitReader(body, max+1)
+	}
+
+	value, err := ioutil.ReadAll(body)
+	if bodyTooBig(c.Request) {
+		s.tooBigResponse(c)
+		return
+	}
+	if err != nil {
+		kvError(c, err)
+		return
+	}
+
+	if max > 0 && int64(len(value)) > max {
+		response := map[string]string{
+			"status": "error",
+			"reason": fmt.Sprintf("Value too big. > %v", max),
+		}
+		c.JSON(400, response)
+		return
+	}
+
+	etag, err := s.kvSet(key, value, c.Request.Header.Get("Content-Type"), c.Request.Header)
+	if err != nil {
+		kvError(c, err)
+		return
+	}
+
+	c.Writer.Header().Set("ETag", etag)
+	response := map[string]string{
+		"status": "ok",
+		"key":    key,
+		"etag":   etag,
+	}
+	c.JSON(200, response)
+}
+
+// kvDeleteHandler removes a key. If-Match is checked right before the
+// delete but not with it, 412 when it fails.
+func (s *S3pal) kvDeleteHandler(c *gin.Context) {
+	key := strings.TrimPrefix(c.Params.ByName("key"), "/")
+
+	if err := s.kvDelete(key, c.Request.Header.Get("If-Match")); err != nil {
+		kvError(c, err)
+		return
+	}
+
+	response := map[string]string{
+		"status": "ok",
+		"key":    key,
+	}
+	c.JSON(200, response)
+}
+
+// listHandler serves /list: the keys (or URLs) under prefix, with detail
+// the objects, paged or with folders as an object
+func (s *S3pal) listHandler(listCache *ListCache) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		prefix := c.Request.FormValue("prefix")
+		urls := strToBool(c.Request.FormValue("urls"))
+		detail := strToBool(c.Request.FormValue("detail"))
+		delimiter := c.Request.FormValue("delimiter")
+		cursor := c.Request.FormValue("cursor")
+		limit, _ := strconv.Atoi(c.Request.FormValue("limit"))
+
+		// paged and folder responses are an object, plain ones stay a list
+		paged := len(cursor) > 0 || limit > 0 || len(delimiter) > 0
+
+		startAfter, err := decodeCursor(cursor)
+		if err != nil {
+			response := map[string]string{
+				"status": "error",
+				"reason": "invalid cursor",
+			}
+			c.JSON(400, response)
+			return
+		}
+
+		cacheKey := listCacheKey(prefix, c.Request.URL.RawQuery)
+
+		var response interface{}
+		cached := false
+		if s.Config.Server.CacheEnabled {
+			response, cached = listCache.get(cacheKey)
+		}
+
+		if cached {
+			log.Println("Cache HIT")
+		} else {
+			var listing *Listing
+			listing, err = s.listDetailed(prefix, delimiter, startAfter, limit, s.Config.Server.SignURL, s.Config.Server.SignTTL)
+
+			if err == nil {
+				var items interface{} = listing.names(urls)
+				if detail {
+					items = listing.Items
+				}
+
+				if paged {
+					body := map[string]interface{}{
+						"items":       items,
+						"next_cursor": encodeCursor(listing.Next),
+					}
+					if len(delimiter) > 0 {
+						body["prefixes"] = listing.Prefixes
+					}
+					response = body
+				} else {
+					response = items
+				}
+			}
+
+			if s.Config.Server.CacheEnabled && err == nil {
+				log.Println("Cache MISS")
+				listCache.set(cacheKey, response, s.Config.Server.CacheTTL)
+			}
+		}
+
+		if err == nil {
+			c.JSON(200, response)
+		} else {
+			response := map[string]string{
+				"status": "error",
+				"reason": "error listing",
+			}
+			c.JSON(500, response)
+		}
+	}
+}
+
 func (s *S3pal) startServer() {
 
 	if s.Config.Server.Debug {
@@ -66,12 +426,13 @@ func (s *S3pal) startServer() {
 
 	r := gin.Default()
 
-	listCache := ListCache{}
+	listCache := &ListCache{}
 
 	listCache.timeout = map[string]int64{}
-	listCache.items = map[string][]string{}
+	listCache.items = map[string]interface{}{}
 
 	r.Use(s.CORSMiddleware())
+	r.Use(s.MaxBodyMiddleware())
 
 	faviconStr := "R0lGODlhAQABAIAAAAUEBAAAACwAAAAAAQABAAACAkQBADs="
 	favicon, _ := base64.StdEncoding.DecodeString(faviconStr)
@@ -83,6 +444,19 @@ func (s *S3pal) startServer() {
 		g.Writer.Write(favicon)
 	})
 
+	if s.Config.Storage.Type == "filesystem" {
+		fmt.Printf("\nServing local storage from /files\n")
+		r.GET("/files/*key", s.AuthMiddleware("read", paramKey), s.serveStoredFile)
+	}
+
+	r.GET("/kv/*key", s.AuthMiddleware("kv_read", s.kvObjectKey), s.kvGetHandler)
+	r.PUT("/kv/*key", s.AuthMiddleware("kv_write", s.kvObjectKey), s.kvPutHandler)
+	r.DELETE("/kv/*key", s.AuthMiddleware("kv_write", s.kvObjectKey), s.kvDeleteHandler)
+
+	r.OPTIONS("/kv/*key", func(c *gin.Context) {
+
+	})
+
 	if len(s.Config.Server.StaticPath) > 0 {
 		path := s.Config.Server.StaticPath
 		fileInfo, err := os.Stat(path)
@@ -103,7 +477,7 @@ func (s *S3pal) startServer() {
 		}
 	}
 
-	r.GET("/", func(g *gin.Context) {
+	r.GET("/", s.AuthMiddleware("", nil), func(g *gin.Context) {
 		content := ""
 		if s.Config.Server.ShowUploadForm {
 			content = s.getUploadForm()
@@ -113,7 +487,7 @@ func (s *S3pal) startServer() {
 		g.Writer.Write([]byte(content))
 	})
 
-	r.POST("/upload/url", func(c *gin.Context) {
+	r.POST("/upload/url", s.AuthMiddleware("upload", nil), func(c *gin.Context) {
 		url := c.Request.FormValue("url")
 		prefix := c.Request.FormValue("prefix")
 
@@ -122,15 +496,29 @@ func (s *S3pal) startServer() {
 		var newFilename string
 		var err error
 		if strings.HasPrefix(url, "http") {
-			newFilename, err = s.uploadPathOrURL(url, prefix)
+			key := s.makeFilename(prefix, path.Base(url))
+			if !s.keyAllowed(c, "upload", key) {
+				return
+			}
+
+			newFilename, err = s.uploadPathOrURLAs(url, key, s.maxPostBytes(), serverSource(c))
 			if err == nil {
 				uploaded = true
 			}
 		}
 
+		if _, rejected := err.(*uploadRejectedError); rejected {
+			response := map[string]string{
+				"status": "error",
+				"reason": err.Error(),
+			}
+			c.JSON(400, response)
+			return
+		}
+
 		if s.Config.Server.CacheEnabled && s.Config.Server.CacheBustOnUpload {
 			log.Println("Cache BUST (upload url)")
-			listCache.timeout[prefix] = 0
+			listCache.bust(prefix)
 		}
 
 		if uploaded {
@@ -148,6 +536,70 @@ func (s *S3pal) startServer() {
 		}
 	})
 
+	r.POST("/upload/presign", s.AuthMiddleware("upload", nil), func(c *gin.Context) {
+		filename := c.Request.FormValue("filename")
+		if len(filename) == 0 {
+			response := map[string]string{
+				"status": "error",
+				"reason": "No \"filename\" field defined",
+			}
+			c.JSON(400, response)
+			return
+		}
+
+		if _, ok := s.getStorage().(PresignStorage); !ok {
+			response := map[string]string{
+				"status": "error",
+				"reason": "storage does not support direct uploads",
+			}
+			c.JSON(501, response)
+			return
+		}
+
+		size, _ := strconv.ParseInt(c.Request.FormValue("size"), 10, 64)
+		method := strings.ToLower(c.Request.FormValue("method"))
+		if len(method) == 0 {
+			method = "post"
+		}
+
+		if method != "post" && method != "put" {
+			response := map[string]string{
+				"status": "error",
+				"reason": "method must be post or put",
+			}
+			c.JSON(400, response)
+			return
+		}
+
+		key := s.makeFilename(c.Request.FormValue("prefix"), filename)
+		if !s.keyAllowed(c, "upload", key) {
+			return
+		}
+
+		response, err := s.presignUpload(filename, key, c.Request.FormValue("content_type"), size, method)
+		if err != nil {
+			code := 500
+			if _, rejected := err.(*uploadRejectedError); rejected {
+				code = 400
+			} else {
+				log.Println(err)
+			}
+
+			response := map[string]string{
+				"status": "error",
+				"reason": err.Error(),
+			}
+			c.JSON(code, response)
+			return
+		}
+
+		c.JSON(200, response)
+	})
+
+	r.OPTIONS("/upload/presign", func(c *gin.Context) {
+
+	})
+
 	r.OPTIONS("/upload/url", func(c *gin.Context) {
 
 	})
@@ -156,9 +608,14 @@ func (s *S3pal) startServer() {
 
 	})
 
-	r.POST("/upload/file", func(c *gin.Context) {
+	r.POST("/upload/file", s.AuthMiddleware("upload", nil), func(c *gin.Context) {
 		file, header, err := c.Request.FormFile("file")
 
+		if bodyTooBig(c.Request) {
+			s.tooBigResponse(c)
+			return
+		}
+
 		if err != nil {
 			fmt.Printf("ERROR: %v (probably no \"file\" field uploaded)\n", err)
 
@@ -173,6 +630,12 @@ func (s *S3pal) startServer() {
 
 		prefix := c.Request.FormValue("prefix")
 
+		newFilename := s.makeFilename(prefix, header.Filename)
+		if !s.keyAllowed(c, "upload", newFilename) {
+			file.Close()
+			return
+		}
+
 		// create a temp file
 		out, err := ioutil.TempFile("/tmp", "uploaded_")
 		if err != nil {
@@ -190,29 +653,39 @@ func (s *S3pal) startServer() {
 
 		fi, _ := out.Stat()
 
-		newFilename := s.makeFilename(prefix, header.Filename)
 		path := out.Name()
 		out.Close()
 		uploaded := false
 
-		max := s.Config.Server.MaxPostBytes
+		max := s.maxPostBytes()
 
 		// handle max post byte
 		// negative max is any size
 		tooBig := false
-		if max == 0 {
-			max = 4000000
-		}
-
 		if max > 0 {
 			tooBig = fi.Size() > max
 		}
 
+		contentType := header.Header.Get("Content-Type")
+		if !s.contentTypeAllowed(contentType) {
+			os.Remove(path)
+
+			response := map[string]string{
+				"status": "error",
+				"reason": fmt.Sprintf("Content type '%s' is not allowed", contentType),
+			}
+			c.JSON(415, response)
+			return
+		}
+
+		var rejected error
 		if !tooBig {
-			err := s.uploadToS3(path, header.Header.Get("Content-Type"), newFilename)
+			err := s.uploadToS3(path, contentType, newFilename, serverSource(c))
 
 			if err == nil {
 				uploaded = true
+			} else if _, ok := err.(*uploadRejectedError); ok {
+				rejected = err
 			} else {
 				log.Println(err)
 			}
@@ -223,14 +696,16 @@ func (s *S3pal) startServer() {
 
 		if s.Config.Server.CacheEnabled && s.Config.Server.CacheBustOnUpload {
 			log.Println("Cache BUST (upload file)")
-			listCache.timeout[prefix] = 0
+			listCache.bust(prefix)
 		}
 
 		// respond
 		if tooBig {
+			s.tooBigResponse(c)
+		} else if rejected != nil {
 			response := map[string]string{
 				"status": "error",
-				"reason": fmt.Sprintf("Upload too big. %v > %v", fi.Size(), max),
+				"reason": rejected.Error(),
 			}
 			c.JSON(400, response)
 		} else if uploaded {
@@ -249,44 +724,7 @@ func (s *S3pal) startServer() {
 		}
 	})
 
-	r.GET("/list", func(c *gin.Context) {
-		prefix := c.Request.FormValue("prefix")
-		urls := strToBool(c.Request.FormValue("urls"))
-
-		makeRequest := true
-
-		if s.Config.Server.CacheEnabled {
-			now := time.Now().Unix()
-			makeRequest = now > listCache.timeout[prefix]
-		}
-
-		var items []string
-		var err error
-		if makeRequest {
-			items, err = s.listS3Bucket(prefix, urls, s.Config.Server.SignURL, s.Config.Server.SignTTL)
-
-			if s.Config.Server.CacheEnabled && err == nil {
-				log.Println("Cache MISS")
-				listCache.items[prefix] = make([]string, len(items))
-				copy(listCache.items[prefix], items)
-				listCache.timeout[prefix] = time.Now().Unix() + s.Config.Server.CacheTTL
-			}
-		} else {
-			items = make([]string, len(listCache.items[prefix]))
-			copy(items, listCache.items[prefix])
-			log.Println("Cache HIT")
-		}
-
-		if err == nil {
-			c.JSON(200, items)
-		} else {
-			response := map[string]string{
-				"status": "error",
-				"reason": "error listing",
-			}
-			c.JSON(500, response)
-		}
-	})
+	r.GET("/list", s.AuthMiddleware("list", listPrefixKey), s.listHandler(listCache))
 
 	port := s.Config.Server.Port
 	fmt.Printf("\ns3pal is running on port %v...\n\n", port)
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// uploadRequest is a multipart POST of size bytes as the file field
+func uploadRequest(size int, chunked bool) *http.Request {
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	part, _ := w.CreateFormFile("file", "big.bin")
+	part.Write(bytes.Repeat([]byte("x"), size))
+	w.Close()
+
+	req, _ := http.NewRequest("POST", "/upload/file", &body)
+	req.Header.Set("Content-Type", w.FormDataContentType())
+	if chunked {
+		req.ContentLength = -1
+	}
+
+	return req
+}
+
+func TestMaxBodyMiddleware(t *testing.T) {
+	s3pal := getS3palWithStorage(newMemStorage())
+	s3pal.Config.Server.MaxPostBytes = 1000
+
+	gin.SetMode(gin.ReleaseMode)
+	r := gin.New()
+	r.Use(s3pal.MaxBodyMiddleware())
+	r.POST("/upload/file", func(c *gin.Context) {
+		_, _, err := c.Request.FormFile("file")
+		if bodyTooBig(c.Request) {
+			s3pal.tooBigResponse(c)
+			return
+		}
+		assert.Nil(t, err)
+		c.JSON(200, map[string]string{"status": "ok"})
+	})
+
+	tests := []struct {
+		size    int
+		chunked bool
+		code    int
+	}{
+		{500, false, 200},
+		{500, true, 200},
+		{maxPostOverhead + 2000, false, 413},
+		{maxPostOverhead + 2000, true, 413},
+	}
+
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, uploadRequest(test.size, test.chunked))
+		assert.Equal(t, test.code, w.Code, fmt.Sprintf("%d bytes chunked %v", test.size, test.chunked))
+	}
+
+	s3pal.Config.Server.MaxPostBytes = -1
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, uploadRequest(maxPostOverhead+2000, false))
+	assert.Equal(t, 200, w.Code)
+}
+
+func TestDownloadURLMax(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// no Content-Length for /chunked
+		if r.URL.Path == "/chunked" {
+			w.Write([]byte(strings.Repeat("x", 10)))
+			w.(http.Flusher).Flush()
+		}
+		w.Write([]byte(strings.Repeat("x", 100)))
+	}))
+	defer server.Close()
+
+	for _, path := range []string{"/", "/chunked"} {
+		name, err := downloadURL(server.URL+path, 200)
+		assert.Nil(t, err)
+		data, _ := ioutil.ReadFile(name)
+		assert.True(t, len(data) >= 100)
+		os.Remove(name)
+
+		_, err = downloadURL(server.URL+path, 50)
+		_, rejected := err.(*uploadRejectedError)
+		assert.True(t, rejected, path)
+
+		name, err = downloadURL(server.URL+path, -1)
+		assert.Nil(t, err)
+		os.Remove(name)
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	sigV4Algorithm  = "AWS4-HMAC-SHA256"
+	sigV4TimeFormat = "20060102T150405Z"
+	// S3 takes this instead of the SHA256 of the body, so bodies can be
+	// streamed without reading them twice
+	unsignedPayload = "UNSIGNED-PAYLOAD"
+	// presigned URLs are valid for at most a week
+	maxPresignExpires = 7 * 24 * time.Hour
+)
+
+// sigV4 signs requests with AWS Signature Version 4, see
+// http://docs.aws.amazon.com/general/latest/gr/signature-version-4.html
+type sigV4 struct {
+	AccessKey string
+	SecretKey string
+	Token     string
+	Region    string
+	Service   string
+}
+
+func sha256Hex(data []byte) string {
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// sigV4Escape percent encodes everything but the unreserved characters
+// (A-Z a-z 0-9 - _ . ~), and / too when keepSlash is false
+func sigV4Escape(s string, keepSlash bool) string {
+	var escaped []byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && keepSlash) {
+			escaped = append(escaped, c)
+		} else {
+			escaped = append(escaped, fmt.Sprintf("%%%02X", c)...)
+		}
+	}
+
+	return string(escaped)
+}
+
+// canonicalQuery sorts the parameters by name, then value
+func canonicalQuery(query url.Values) string {
+	var params []string
+	for name, values := range query {
+		for _, value := range values {
+			params = append(params, sigV4Escape(name, false)+"="+sigV4Escape(value, false))
+		}
+	}
+	sort.Strings(params)
+
+	return strings.Join(params, "&")
+}
+
+// canonicalPath is the escaped path of u. S3 paths (keys) are used as is,
+// without removing . and .. segments.
+func canonicalPath(u *url.URL) string {
+	if len(u.Path) == 0 {
+		return "/"
+	}
+
+	return sigV4Escape(u.Path, true)
+}
+
+// setCanonicalURL makes the request go out with the same escaping that is
+// signed. Go escapes paths its own way, an opaque URL is sent as is.
+func setCanonicalURL(req *http.Request) {
+	req.URL.Opaque = "//" + req.URL.Host + canonicalPath(req.URL)
+	req.URL.RawQuery = canonicalQuery(req.URL.Query())
+}
+
+// signedHeaderNames are the lower case header names to sign: all of them
+// except those proxies and clients change on the way
+func signedHeaderNames(req *http.Request) []string {
+	names := []string{"host"}
+	for name := range req.Header {
+		name = strings.ToLower(name)
+		switch name {
+		case "host", "authorization", "user-agent", "content-length", "expect", "accept-encoding", "connection":
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+func canonicalHeaderValue(values []string) string {
+	trimmed := make([]string, len(values))
+	for i, value := range values {
+		trimmed[i] = strings.Join(strings.Fields(value), " ")
+	}
+
+	return strings.Join(trimmed, ",")
+}
+
+func (v sigV4) canonicalRequest(req *http.Request, names []string, payloadHash string) string {
+	var headers []string
+	for _, name := range names {
+		value := ""
+		if name == "host" {
+			value = req.Host
+			if len(value) == 0 {
+				value = req.URL.Host
+			}
+		} else {
+			value = canonicalHeaderValue(req.Header[http.CanonicalHeaderKey(name)])
+		}
+		headers = append(headers, name+":"+value+"\n")
+	}
+
+	return strings.Join([]string{
+		req.Method,
+		canonicalPath(req.URL),
+		canonicalQuery(req.URL.Query()),
+		strings.Join(headers, ""),
+		strings.Join(names, ";"),
+		payloadHash,
+	}, "\n")
+}
+
+func (v sigV4) scope(t time.Time) string {
+	return strings.Join([]string{t.Format("20060102"), v.Region, v.Service, "aws4_request"}, "/")
+}
+
+func (v sigV4) stringToSign(t time.Time, canonicalRequest string) string {
+	return strings.Join([]string{
+		sigV4Algorithm,
+		t.Format(sigV4TimeFormat),
+		v.scope(t),
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+}
+
+func (v sigV4) signature(t time.Time, stringToSign string) string {
+	key := hmacSHA256([]byte("AWS4"+v.SecretKey), t.Format("20060102"))
+	key = hmacSHA256(key, v.Region)
+	key = hmacSHA256(key, v.Service)
+	key = hmacSHA256(key, "aws4_request")
+
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+// sign adds the X-Amz-Date, X-Amz-Content-Sha256 (for S3), session token
+// and Authorization headers. payloadHash is the hex SHA256 of the body or
+// unsignedPayload.
+func (v sigV4) sign(req *http.Request, payloadHash string, now time.Time) {
+	t := now.UTC()
+
+	req.Header.Set("X-Amz-Date", t.Format(sigV4TimeFormat))
+	if v.Service == "s3" {
+		req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	}
+	if len(v.Token) > 0 {
+		req.Header.Set("X-Amz-Security-Token", v.Token)
+	}
+
+	names := signedHeaderNames(req)
+	signature := v.signature(t, v.stringToSign(t, v.canonicalRequest(req, names, payloadHash)))
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		sigV4Algorithm, v.AccessKey, v.scope(t), strings.Join(names, ";"), signature))
+}
+
+// presign returns the URL of req with the signature in the query string,
+// valid for expires (at most a week). The host and the headers of req are
+// signed, whoever uses the URL has to send those headers as they are.
+func (v sigV4) presign(req *http.Request, expires time.Duration, now time.Time) string {
+	t := now.UTC()
+
+	if expires > maxPresignExpires {
+		expires = maxPresignExpires
+	}
+
+	names := []string{"host"}
+	for name := range req.Header {
+		names = append(names, strings.ToLower(name))
+	}
+	sort.Strings(names)
+
+	query := req.URL.Query()
+	query.Set("X-Amz-Algorithm", sigV4Algorithm)
+	query.Set("X-Amz-Credential", v.AccessKey+"/"+v.scope(t))
+	query.Set("X-Amz-Date", t.Format(sigV4TimeFormat))
+	query.Set("X-Amz-Expires", fmt.Sprintf("%d", int64((expires+time.Second/2)/time.Second)))
+	query.Set("X-Amz-SignedHeaders", strings.Join(names, ";"))
+	if len(v.Token) > 0 {
+		query.Set("X-Amz-Security-Token", v.Token)
+	}
+	req.URL.RawQuery = query.Encode()
+
+	canonical := v.canonicalRequest(req, names, unsignedPayload)
+	signature := v.signature(t, v.stringToSign(t, canonical))
+
+	return fmt.Sprintf("%s://%s%s?%s&X-Amz-Signature=%s", req.URL.Scheme, req.URL.Host, canonicalPath(req.URL), canonicalQuery(query), signature)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Storage is what S3pal uploads to, lists from and builds URLs for. The
+// S3 bucket is the default implementation (see s3storage.go),
+// fsstorage.go keeps objects on local disk.
+type Storage interface {
+	// Put stores size bytes read from r under key. headers are sent as is
+	// (Content-Type, Cache-Control, x-amz-meta-*, ...). An If-Match or
+	// If-None-Match: * header makes the write conditional, it fails with
+	// ErrPreconditionFailed when the condition does not hold. It returns
+	// the ETag of the stored object.
+	Put(key string, r io.Reader, size int64, headers http.Header, acl string) (string, error)
+	// Get returns a reader for the object's content. Callers must close it.
+	Get(key string) (io.ReadCloser, error)
+	// List returns at most max (0 means the backend default) objects
+	// starting with prefix and sorting after marker. A non-empty delim
+	// groups keys into CommonPrefixes.
+	List(prefix, delim, marker string, max int) (*ListResult, error)
+	Delete(key string) error
+	Head(key string) (*ObjectInfo, error)
+	URL(key string) string
+	SignedURL(key string, expires time.Time) string
+}
+
+var (
+	ErrNotFound           = errors.New("not found")
+	ErrPreconditionFailed = errors.New("precondition failed")
+)
+
+// headers that make a Put conditional, they are not stored with the object
+var conditionalHeaderNames = []string{"If-Match", "If-None-Match"}
+
+// checkPreconditions tests If-Match and If-None-Match: * of headers
+// against the current object, nil when there is none.
+func checkPreconditions(headers http.Header, current *ObjectInfo) error {
+	if ifNoneMatch := headers.Get("If-None-Match"); len(ifNoneMatch) > 0 {
+		if ifNoneMatch != "*" {
+			return fmt.Errorf("only If-None-Match: * is supported")
+		}
+
+		if current != nil {
+			return ErrPreconditionFailed
+		}
+	}
+
+	if ifMatch := headers.Get("If-Match"); len(ifMatch) > 0 {
+		if current == nil {
+			return ErrPreconditionFailed
+		}
+
+		if ifMatch != "*" && strings.Trim(ifMatch, `"`) != strings.Trim(current.ETag, `"`) {
+			return ErrPreconditionFailed
+		}
+	}
+
+	return nil
+}
+
+type ObjectInfo struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
+	ETag         string
+	StorageClass string
+	ContentType  string
+	Headers      http.Header
+}
+
+type ListResult struct {
+	Objects        []ObjectInfo
+	CommonPrefixes []string
+	IsTruncated    bool
+	NextMarker     string
+}
+
+// storageMu guards the lazily made Storage, gin handlers and workers ask
+// for it at the same time
+var storageMu sync.Mutex
+
+func (s *S3pal) getStorage() Storage {
+	storageMu.Lock()
+	defer storageMu.Unlock()
+
+	if s.Storage == nil {
+		s.Storage = s.newStorage(s.Config.Aws.Bucket)
+	}
+
+	return s.Storage
+}
+
+// storageFor is the storage of another bucket, with the same settings
+func (s *S3pal) storageFor(bucket string) Storage {
+	if bucket == s.Config.Aws.Bucket {
+		return s.getStorage()
+	}
+
+	return s.newStorage(bucket)
+}
+
+func (s *S3pal) newStorage(bucket string) Storage {
+	switch s.Config.Storage.Type {
+	case "filesystem":
+		return s.newFilesystemStorage(bucket)
+	default:
+		config := s.Config.Aws
+		config.Bucket = bucket
+		return newS3Storage(config)
+	}
+}
+
+func (s *S3pal) newFilesystemStorage(bucket string) *filesystemStorage {
+	root := s.Config.Storage.Root
+	if len(root) == 0 {
+		root = "s3pal_storage"
+	}
+
+	if len(bucket) > 0 {
+		root = filepath.Join(root, bucket)
+	}
+
+	baseURL := s.Config.Storage.BaseURL
+	if len(baseURL) == 0 {
+		host := s.Config.Server.Host
+		if len(host) == 0 {
+			host = "localhost"
+		}
+
+		port := s.Config.Server.Port
+		if port == 0 {
+			port = 8080
+		}
+
+		baseURL = fmt.Sprintf("http://%s:%d/files", host, port)
+	}
+
+	return newFilesystemStorage(root, baseURL)
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type memObject struct {
+	data    []byte
+	headers http.Header
+	acl     string
+	etag    string
+}
+
+// memStorage keeps objects in a map so tests never talk to S3
+type memStorage struct {
+	objects map[string]*memObject
+	uploads map[string]map[int][]byte
+	// key and start of every upload
+	started map[string]MultipartUpload
+	mu      sync.Mutex
+}
+
+func newMemStorage() *memStorage {
+	return &memStorage{
+		objects: map[string]*memObject{},
+		uploads: map[string]map[int][]byte{},
+		started: map[string]MultipartUpload{},
+	}
+}
+
+func (m *memStorage) Put(key string, r io.Reader, size int64, headers http.Header, acl string) (string, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+
+	sum := md5.Sum(data)
+	etag := `"` + hex.EncodeToString(sum[:]) + `"`
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.objects[key] = &memObject{data: data, headers: headers, acl: acl, etag: etag}
+	return etag, nil
+}
+
+func (m *memStorage) Get(key string) (io.ReadCloser, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	obj, ok := m.objects[key]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	return ioutil.NopCloser(bytes.NewReader(obj.data)), nil
+}
+
+func (m *memStorage) List(prefix, delim, marker string, max int) (*ListResult, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var keys []string
+	for key := range m.objects {
+		if strings.HasPrefix(key, prefix) && key > marker {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	if max <= 0 {
+		max = 1000
+	}
+
+	result := &ListResult{}
+	for _, key := range keys {
+		if len(result.Objects) == max {
+			result.IsTruncated = true
+			result.NextMarker = result.Objects[max-1].Key
+			break
+		}
+		result.Objects = append(result.Objects, ObjectInfo{Key: key, Size: int64(len(m.objects[key].data))})
+	}
+
+	return result, nil
+}
+
+func (m *memStorage) Delete(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.objects, key)
+	return nil
+}
+
+func (m *memStorage) Head(key string) (*ObjectInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	obj, ok := m.objects[key]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	return &ObjectInfo{Key: key, Size: int64(len(obj.data)), ContentType: obj.headers.Get("Content-Type"), Headers: obj.headers, ETag: obj.etag}, nil
+}
+
+func (m *memStorage) URL(key string) string {
+	return "mem://" + key
+}
+
+func (m *memStorage) SignedURL(key string, expires time.Time) string {
+	return fmt.Sprintf("mem://%s?expires=%d", key, expires.Unix())
+}
+
+func (m *memStorage) GetACL(key string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	obj, ok := m.objects[key]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	return []byte(obj.acl), nil
+}
+
+func (m *memStorage) PutACL(key string, acl []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	obj, ok := m.objects[key]
+	if !ok {
+		return ErrNotFound
+	}
+
+	obj.acl = string(acl)
+	return nil
+}
+
+func (m *memStorage) InitMultipart(key string, headers http.Header, acl string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	uploadID := fmt.Sprintf("upload-%d", len(m.uploads)+1)
+	m.uploads[uploadID] = map[int][]byte{}
+	m.started[uploadID] = MultipartUpload{Key: key, UploadID: uploadID, Initiated: time.Now()}
+	return uploadID, nil
+}
+
+func (m *memStorage) PutPart(key string, uploadID string, n int, r io.ReadSeeker) (UploadPart, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return UploadPart{}, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.uploads[uploadID][n] = data
+	return UploadPart{N: n, ETag: fmt.Sprintf("etag-%d", n), Size: int64(len(data))}, nil
+}
+
+func (m *memStorage) CompleteMultipart(key string, uploadID string, parts []UploadPart) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var data []byte
+	for _, part := range parts {
+		data = append(data, m.uploads[uploadID][part.N]...)
+	}
+
+	delete(m.uploads, uploadID)
+	m.objects[key] = &memObject{data: data, headers: http.Header{}}
+	return nil
+}
+
+func (m *memStorage) AbortMultipart(key string, uploadID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.uploads, uploadID)
+	return nil
+}
+
+func (m *memStorage) ListMultipart(prefix string) ([]MultipartUpload, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var result []MultipartUpload
+	for uploadID := range m.uploads {
+		if upload := m.started[uploadID]; strings.HasPrefix(upload.Key, prefix) {
+			result = append(result, upload)
+		}
+	}
+
+	return result, nil
+}
+
+func getS3palWithStorage(storage Storage) *S3pal {
+	config := S3palConfig{
+		Aws: AwsConfig{
+			ACL:           "public-read",
+			UploadHeaders: map[string]string{"Cache-Control": "max-age=60"},
+		},
+	}
+
+	return &S3pal{
+		Config:  config,
+		Storage: storage,
+	}
+}
+
+func TestUploadToStorage(t *testing.T) {
+	storage := newMemStorage()
+	s3pal := getS3palWithStorage(storage)
+
+	tmp, _ := ioutil.TempFile("", "s3pal_test_")
+	tmp.WriteString("hello")
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	err := s3pal.uploadToS3(tmp.Name(), "", "test/hello.txt", cliSource)
+	assert.Nil(t, err)
+
+	obj := storage.objects["test/hello.txt"]
+	assert.Equal(t, "hello", string(obj.data))
+	assert.Equal(t, "binary/octet-stream", obj.headers.Get("Content-Type"))
+	assert.Equal(t, "max-age=60", obj.headers.Get("Cache-Control"))
+	assert.Equal(t, "public-read", obj.acl)
+}
+
+func TestListStorage(t *testing.T) {
+	storage := newMemStorage()
+	storage.objects["a/1.jpg"] = &memObject{}
+	storage.objects["a/2.jpg"] = &memObject{}
+	storage.objects["b/1.jpg"] = &memObject{}
+	s3pal := getS3palWithStorage(storage)
+
+	keys, next, err := s3pal.listS3Bucket("a/", "", 0, false, false, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"a/1.jpg", "a/2.jpg"}, keys)
+	assert.Equal(t, "", next)
+
+	urls, _, _ := s3pal.listS3Bucket("b/", "", 0, true, false, 0)
+	assert.Equal(t, []string{"mem://b/1.jpg"}, urls)
+}
+
+func TestListFollowsMarkers(t *testing.T) {
+	storage := newMemStorage()
+	for i := 0; i < 2500; i++ {
+		storage.objects[fmt.Sprintf("k/%04d", i)] = &memObject{}
+	}
+	s3pal := getS3palWithStorage(storage)
+
+	keys, next, err := s3pal.listS3Bucket("k/", "", 0, false, false, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 2500, len(keys))
+	assert.Equal(t, "", next)
+
+	keys, next, _ = s3pal.listS3Bucket("k/", "", 1200, false, false, 0)
+	assert.Equal(t, 1200, len(keys))
+	assert.Equal(t, "k/1199", next)
+
+	keys, next, _ = s3pal.listS3Bucket("k/", next, 0, false, false, 0)
+	assert.Equal(t, 1300, len(keys))
+	assert.Equal(t, "k/1200", keys[0])
+	assert.Equal(t, "", next)
+}
+
+func TestUploadParts(t *testing.T) {
+	storage := newMemStorage()
+	content := "abcdefghijklmnopqrstuvwxyz"
+
+	uploadID, _ := storage.InitMultipart("big.txt", http.Header{}, "private")
+	parts, err := uploadParts(storage, "big.txt", uploadID, strings.NewReader(content), int64(len(content)), 5, 3, nil, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 6, len(parts))
+	assert.Equal(t, int64(1), parts[5].Size)
+
+	storage.CompleteMultipart("big.txt", uploadID, parts)
+	assert.Equal(t, content, string(storage.objects["big.txt"].data))
+}
+
+func TestUploadPartsResume(t *testing.T) {
+	storage := newMemStorage()
+	content := "abcdefghijklmnopqrstuvwxyz"
+
+	uploadID, _ := storage.InitMultipart("big.txt", http.Header{}, "private")
+	storage.uploads[uploadID][1] = []byte("abcde")
+	done := map[int]UploadPart{
+		1: UploadPart{N: 1, ETag: "etag-1", Size: 5},
+	}
+
+	var sent []int
+	parts, err := uploadParts(storage, "big.txt", uploadID, strings.NewReader(content), int64(len(content)), 5, 1, done, func(part UploadPart) {
+		sent = append(sent, part.N)
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []int{2, 3, 4, 5, 6}, sent)
+
+	storage.CompleteMultipart("big.txt", uploadID, parts)
+	assert.Equal(t, content, string(storage.objects["big.txt"].data))
+}
+
+func TestJournalFindsSameFile(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "s3pal_journal_")
+	defer os.RemoveAll(dir)
+	journal := &multipartJournal{dir: dir}
+
+	tmp, _ := ioutil.TempFile("", "s3pal_test_")
+	tmp.WriteString("hello")
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	entry, err := journal.create("mybucket", tmp.Name(), "uploads/hello.txt", "upload-1", 5)
+	assert.Nil(t, err)
+	entry.addPart(UploadPart{N: 1, ETag: "etag-1", Size: 5})
+
+	found := journal.find("mybucket", tmp.Name())
+	assert.Equal(t, "uploads/hello.txt", found.Key)
+	assert.Equal(t, "etag-1", found.Parts[1].ETag)
+	assert.Nil(t, journal.find("otherbucket", tmp.Name()))
+
+	// a changed file is a new upload
+	ioutil.WriteFile(tmp.Name(), []byte("hello world"), 0644)
+	assert.Nil(t, journal.find("mybucket", tmp.Name()))
+
+	entry.remove()
+	assert.Equal(t, 0, len(journal.entries()))
+}
+
+func TestAbortOnlyOrphanedUploads(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "s3pal_journal_")
+	defer os.RemoveAll(dir)
+
+	storage := newMemStorage()
+	s3pal := getS3palWithStorage(storage)
+	s3pal.Config.Aws.MultipartJournal = dir
+
+	tmp, _ := ioutil.TempFile("", "s3pal_test_")
+	tmp.WriteString("hello")
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	journaled, _ := storage.InitMultipart("journaled.txt", http.Header{}, "private")
+	s3pal.getJournal().create("", tmp.Name(), "journaled.txt", journaled, 5)
+
+	young, _ := storage.InitMultipart("young.txt", http.Header{}, "private")
+
+	orphaned, _ := storage.InitMultipart("orphaned.txt", http.Header{}, "private")
+	upload := storage.started[orphaned]
+	upload.Initiated = time.Now().Add(-48 * time.Hour)
+	storage.started[orphaned] = upload
+
+	err := s3pal.listMultipartUploads("", abortOptions{Abort: true, OlderThan: 24 * time.Hour})
+	assert.Nil(t, err)
+
+	_, ok := storage.uploads[orphaned]
+	assert.False(t, ok)
+	_, ok = storage.uploads[journaled]
+	assert.True(t, ok)
+	_, ok = storage.uploads[young]
+	assert.True(t, ok)
+	assert.Equal(t, 1, len(s3pal.getJournal().entries()))
+
+	// an upload id aborts even a journaled upload
+	err = s3pal.listMultipartUploads("", abortOptions{Abort: true, UploadID: journaled, OlderThan: 24 * time.Hour})
+	assert.Nil(t, err)
+
+	_, ok = storage.uploads[journaled]
+	assert.False(t, ok)
+	_, ok = storage.uploads[young]
+	assert.True(t, ok)
+	assert.Equal(t, 0, len(s3pal.getJournal().entries()))
+
+	err = s3pal.listMultipartUploads("", abortOptions{Abort: true, UploadID: "nope"})
+	assert.NotNil(t, err)
+}
+
+func TestGetStorageConcurrent(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "s3pal_storage_")
+	defer os.RemoveAll(dir)
+
+	s3pal := &S3pal{Config: S3palConfig{Storage: StorageConfig{Type: "filesystem", Root: dir}}}
+
+	var wg sync.WaitGroup
+	storages := make([]Storage, 10)
+	for i := range storages {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			storages[i] = s3pal.getStorage()
+		}(i)
+	}
+	wg.Wait()
+
+	for _, storage := range storages {
+		assert.True(t, storage == storages[0])
+	}
+}
@@ -0,0 +1,433 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const defaultSyncConcurrency = 4
+
+type syncOptions struct {
+	Delete  bool
+	DryRun  bool
+	Include []string
+	Exclude []string
+	// "md5" (default) or "mtime"
+	Compare     string
+	Concurrency int
+	// file to write the syncChanges to as JSON
+	Manifest string
+}
+
+type syncChange struct {
+	Action string `json:"action"`
+	Key    string `json:"key"`
+	Path   string `json:"path"`
+	Error  string `json:"error,omitempty"`
+}
+
+type syncSummary struct {
+	Transferred int
+	Unchanged   int
+	Deleted     int
+	// uploads a pre_upload hook refused
+	Skipped int
+	Failed  int
+	Changes []syncChange
+}
+
+// add counts a change and keeps it for the manifest
+func (s *syncSummary) add(action string, key string, localPath string, err error) {
+	change := syncChange{Action: action, Key: key, Path: localPath}
+
+	if _, rejected := err.(*uploadRejectedError); rejected {
+		change.Action = "skipped"
+		change.Error = err.Error()
+		s.Skipped++
+	} else if err != nil {
+		change.Action = "failed"
+		change.Error = err.Error()
+		s.Failed++
+	} else if action == "deleted" {
+		s.Deleted++
+	} else {
+		s.Transferred++
+	}
+
+	s.Changes = append(s.Changes, change)
+}
+
+func (s syncSummary) String() string {
+	return fmt.Sprintf("%v Transferred, %v Unchanged, %v Deleted, %v Skipped, %v Failed", s.Transferred, s.Unchanged, s.Deleted, s.Skipped, s.Failed)
+}
+
+// included applies the include and exclude patterns (see matchKey) to a
+// path relative to what is being synced. Excludes win.
+func (o syncOptions) included(rel string) bool {
+	for _, pattern := range o.Exclude {
+		if matchKey(pattern, rel) {
+			return false
+		}
+	}
+
+	if len(o.Include) == 0 {
+		return true
+	}
+
+	for _, pattern := range o.Include {
+		if matchKey(pattern, rel) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// unchanged compares a local file to an object. With "mtime" (or for
+// multipart ETags, which are not an MD5) the file must be the same size
+// and not newer, otherwise same size and MD5.
+func (o syncOptions) unchanged(localPath string, fi os.FileInfo, item ListItem) bool {
+	if fi.Size() != item.Size {
+		return false
+	}
+
+	if o.Compare == "mtime" || len(item.ETag) == 0 || strings.Contains(item.ETag, "-") {
+		return !fi.ModTime().After(item.LastModified)
+	}
+
+	sum, err := fileMD5(localPath)
+	return err == nil && sum == item.ETag
+}
+
+func syncPrefix(prefix string) string {
+	if len(prefix) > 0 && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+
+	return prefix
+}
+
+// contentTypeFor goes by extension first so .css and .js files get the
+// right type, which sniffing can not tell.
+func contentTypeFor(localPath string) string {
+	if contentType := mime.TypeByExtension(filepath.Ext(localPath)); len(contentType) > 0 {
+		return contentType
+	}
+
+	contentType, _ := detectContentType(localPath)
+	return contentType
+}
+
+// localFiles walks dir and returns the files in it by slash separated
+// path relative to dir.
+func localFiles(dir string) (map[string]os.FileInfo, error) {
+	files := map[string]os.FileInfo{}
+
+	err := filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+
+		files[filepath.ToSlash(rel)] = fi
+		return nil
+	})
+
+	return files, err
+}
+
+// syncUp uploads the files of dir that are missing or changed under
+// prefix and, with opts.Delete, deletes objects that have no local file.
+func (s *S3pal) syncUp(dir string, prefix string, opts syncOptions) (syncSummary, error) {
+	summary := syncSummary{}
+	prefix = syncPrefix(prefix)
+
+	files, err := localFiles(dir)
+	if err != nil {
+		return summary, err
+	}
+
+	listing, err := s.listDetailed(prefix, "", "", 0, false, 0)
+	if err != nil {
+		return summary, err
+	}
+
+	remote := map[string]ListItem{}
+	for _, item := range listing.Items {
+		remote[item.Key[len(prefix):]] = item
+	}
+
+	var rels []string
+	for rel := range files {
+		rels = append(rels, rel)
+	}
+	sort.Strings(rels)
+
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = defaultSyncConcurrency
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	sem := make(chan bool, opts.Concurrency)
+
+	for _, rel := range rels {
+		if !opts.included(rel) {
+			continue
+		}
+
+		localPath := filepath.Join(dir, filepath.FromSlash(rel))
+		if item, ok := remote[rel]; ok && opts.unchanged(localPath, files[rel], item) {
+			summary.Unchanged++
+			continue
+		}
+
+		key := prefix + rel
+		if opts.DryRun {
+			fmt.Printf("Would upload %s to %s\n", localPath, key)
+			summary.add("uploaded", key, localPath, nil)
+			continue
+		}
+
+		wg.Add(1)
+		sem <- true
+		go func(localPath string, key string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			err := s.uploadToS3(localPath, contentTypeFor(localPath), key, cliSource)
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			if _, rejected := err.(*uploadRejectedError); rejected {
+				fmt.Printf("Skipped %s: %v\n", localPath, err)
+			} else if err != nil {
+				fmt.Printf("Error uploading %s: %v\n", localPath, err)
+			}
+			summary.add("uploaded", key, localPath, err)
+		}(localPath, key)
+	}
+
+	wg.Wait()
+
+	if opts.Delete {
+		var orphans []string
+		for rel, item := range remote {
+			if _, ok := files[rel]; !ok && opts.included(rel) {
+				orphans = append(orphans, item.Key)
+			}
+		}
+		sort.Strings(orphans)
+
+		if opts.DryRun {
+			for _, key := range orphans {
+				fmt.Printf("Would delete %s\n", key)
+			}
+		} else if len(orphans) > 0 {
+			var deleted int
+			deleted, err = s.deleteKeys(orphans, os.Stdout)
+			orphans = orphans[:deleted]
+		}
+
+		for _, key := range orphans {
+			summary.add("deleted", key, "", nil)
+		}
+
+		if err != nil {
+			return summary, err
+		}
+	}
+
+	return summary, nil
+}
+
+// syncDown downloads the objects under prefix that are missing or changed
+// in dir and, with opts.Delete, deletes local files that have no object.
+// Keys that would end up outside of dir are skipped.
+func (s *S3pal) syncDown(prefix string, dir string, opts syncOptions) (syncSummary, error) {
+	summary := syncSummary{}
+	prefix = syncPrefix(prefix)
+
+	listing, err := s.listDetailed(prefix, "", "", 0, false, 0)
+	if err != nil {
+		return summary, err
+	}
+
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return summary, err
+	}
+
+	files, err := localFiles(dir)
+	if err != nil {
+		return summary, err
+	}
+
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = defaultSyncConcurrency
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	sem := make(chan bool, opts.Concurrency)
+	remote := map[string]bool{}
+
+	for _, item := range listing.Items {
+		rel := item.Key[len(prefix):]
+
+		// folder placeholders made by the S3 console
+		if len(rel) == 0 || strings.HasSuffix(rel, "/") || !opts.included(rel) {
+			continue
+		}
+
+		localPath, err := localPathForKey(dir, rel)
+		if err != nil {
+			fmt.Printf("Skipped %s: %v\n", item.Key, err)
+			summary.add("downloaded", item.Key, "", err)
+			continue
+		}
+
+		remote[rel] = true
+
+		if fi, ok := files[rel]; ok && opts.unchanged(localPath, fi, item) {
+			summary.Unchanged++
+			continue
+		}
+
+		if opts.DryRun {
+			fmt.Printf("Would download %s to %s\n", item.Key, localPath)
+			summary.add("downloaded", item.Key, localPath, nil)
+			continue
+		}
+
+		wg.Add(1)
+		sem <- true
+		go func(item ListItem, localPath string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			err := s.download(item.Key, localPath, item.LastModified)
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			if err != nil {
+				fmt.Printf("Error downloading %s: %v\n", item.Key, err)
+			} else {
+				fmt.Printf("Downloaded %s\n", localPath)
+			}
+			summary.add("downloaded", item.Key, localPath, err)
+		}(item, localPath)
+	}
+
+	wg.Wait()
+
+	if opts.Delete {
+		var orphans []string
+		for rel := range files {
+			if !remote[rel] && opts.included(rel) {
+				orphans = append(orphans, rel)
+			}
+		}
+		sort.Strings(orphans)
+
+		for _, rel := range orphans {
+			localPath := filepath.Join(dir, filepath.FromSlash(rel))
+			if opts.DryRun {
+				fmt.Printf("Would delete %s\n", localPath)
+				summary.add("deleted", "", localPath, nil)
+				continue
+			}
+
+			err := os.Remove(localPath)
+			if err == nil {
+				fmt.Printf("Deleted %s\n", localPath)
+			}
+			summary.add("deleted", "", localPath, err)
+		}
+	}
+
+	return summary, nil
+}
+
+func writeSyncManifest(file string, summary syncSummary) error {
+	changes := summary.Changes
+	if changes == nil {
+		changes = []syncChange{}
+	}
+
+	data, err := json.MarshalIndent(changes, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(file, data, 0644)
+}
+
+// syncCommand syncs in the direction of its arguments: a local folder to
+// s3://bucket/prefix uploads, s3://bucket/prefix to a folder downloads.
+func (s *S3pal) syncCommand(src string, dst string, opts syncOptions) error {
+	up := strings.HasPrefix(dst, "s3://") && !strings.HasPrefix(src, "s3://")
+	down := strings.HasPrefix(src, "s3://") && !strings.HasPrefix(dst, "s3://")
+
+	if !up && !down {
+		return fmt.Errorf("use s3pal sync <dir> s3://bucket/prefix or s3pal sync s3://bucket/prefix <dir>")
+	}
+
+	remote, dir := dst, src
+	if down {
+		remote, dir = src, dst
+	}
+
+	if up {
+		fi, err := os.Stat(dir)
+		if err != nil || !fi.IsDir() {
+			return fmt.Errorf("'%s' is not a folder", dir)
+		}
+	}
+
+	bucket, prefix := parseS3Path(remote, s.Config.Aws.Bucket)
+	if bucket != s.Config.Aws.Bucket {
+		other := *s
+		other.Config.Aws.Bucket = bucket
+		other.Storage = s.storageFor(bucket)
+		s = &other
+	}
+
+	var summary syncSummary
+	var err error
+	if up {
+		summary, err = s.syncUp(dir, prefix, opts)
+	} else {
+		summary, err = s.syncDown(prefix, dir, opts)
+	}
+
+	fmt.Printf("\n%v\n", summary)
+
+	if len(opts.Manifest) > 0 {
+		if manifestErr := writeSyncManifest(opts.Manifest, summary); manifestErr != nil {
+			fmt.Printf("Could not write manifest '%s': %v\n", opts.Manifest, manifestErr)
+		}
+	}
+
+	if err == nil && summary.Failed > 0 {
+		err = fmt.Errorf("%d files not synced", summary.Failed)
+	}
+
+	return err
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSyncUp(t *testing.T) {
+	storage := newTempFilesystemStorage()
+	defer os.RemoveAll(storage.root)
+	putString(storage, "site/old.html", "gone")
+
+	dir, _ := ioutil.TempDir("", "s3pal_sync_")
+	defer os.RemoveAll(dir)
+	os.MkdirAll(filepath.Join(dir, "css"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "index.html"), []byte("<html></html>"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "css", "main.css"), []byte("body {}"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "notes.tmp"), []byte("tmp"), 0644)
+
+	s3pal := getS3palWithStorage(storage)
+	opts := syncOptions{Exclude: []string{"*.tmp"}, Delete: true}
+
+	summary, err := s3pal.syncUp(dir, "site", opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, summary.Transferred)
+	assert.Equal(t, 1, summary.Deleted)
+
+	info, _ := storage.Head("site/css/main.css")
+	assert.Contains(t, info.ContentType, "text/css")
+	_, err = storage.Head("site/notes.tmp")
+	assert.NotNil(t, err)
+
+	ioutil.WriteFile(filepath.Join(dir, "index.html"), []byte("<html>new</html>"), 0644)
+	summary, _ = s3pal.syncUp(dir, "site/", opts)
+	assert.Equal(t, 1, summary.Transferred)
+	assert.Equal(t, 1, summary.Unchanged)
+}
+
+func TestSyncDown(t *testing.T) {
+	storage := newTempFilesystemStorage()
+	defer os.RemoveAll(storage.root)
+	putString(storage, "uploads/2015/a.jpg", "a")
+	putString(storage, "uploads/2016/b.jpg", "b")
+
+	dir, _ := ioutil.TempDir("", "s3pal_sync_")
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "local-only.txt"), []byte("x"), 0644)
+
+	s3pal := getS3palWithStorage(storage)
+	summary, err := s3pal.syncDown("uploads/", dir, syncOptions{Delete: true})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, summary.Transferred)
+	assert.Equal(t, 1, summary.Deleted)
+
+	data, _ := ioutil.ReadFile(filepath.Join(dir, "2016", "b.jpg"))
+	assert.Equal(t, "b", string(data))
+
+	summary, _ = s3pal.syncDown("uploads", dir, syncOptions{})
+	assert.Equal(t, 0, summary.Transferred)
+	assert.Equal(t, 2, summary.Unchanged)
+
+	manifest := filepath.Join(dir, "..", filepath.Base(dir)+".json")
+	defer os.Remove(manifest)
+	putString(storage, "uploads/2015/a.jpg", "changed")
+	summary, _ = s3pal.syncDown("uploads", dir, syncOptions{})
+	assert.Nil(t, writeSyncManifest(manifest, summary))
+	data, _ = ioutil.ReadFile(manifest)
+	assert.Contains(t, string(data), `"key": "uploads/2015/a.jpg"`)
+}
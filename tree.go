@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+type treeNode struct {
+	name     string
+	count    int
+	size     int64
+	folders  map[string]*treeNode
+	children []ListItem
+}
+
+func newTreeNode(name string) *treeNode {
+	return &treeNode{name: name, folders: map[string]*treeNode{}}
+}
+
+// add counts the object in this folder and every folder on the way to it
+func (n *treeNode) add(rel string, item ListItem) {
+	n.count++
+	n.size += item.Size
+
+	i := strings.Index(rel, "/")
+	if i < 0 {
+		n.children = append(n.children, item)
+		return
+	}
+
+	name := rel[:i+1]
+	folder, ok := n.folders[name]
+	if !ok {
+		folder = newTreeNode(name)
+		n.folders[name] = folder
+	}
+
+	folder.add(rel[i+1:], item)
+}
+
+func humanSize(size int64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB", "PB"}
+	value := float64(size)
+	i := 0
+	for value >= 1024 && i < len(units)-1 {
+		value /= 1024
+		i++
+	}
+
+	if i == 0 {
+		return fmt.Sprintf("%d B", size)
+	}
+
+	return fmt.Sprintf("%.1f %s", value, units[i])
+}
+
+func (n *treeNode) summary() string {
+	objects := "objects"
+	if n.count == 1 {
+		objects = "object"
+	}
+
+	return fmt.Sprintf("%s (%d %s, %s)", n.name, n.count, objects, humanSize(n.size))
+}
+
+func (n *treeNode) print(w io.Writer, indent string, files bool, depth int) {
+	if depth == 0 {
+		return
+	}
+
+	var names []string
+	for name := range n.folders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	lines := len(names)
+	if files {
+		lines += len(n.children)
+	}
+
+	for i, name := range names {
+		branch, next := "├── ", "│   "
+		if i == lines-1 {
+			branch, next = "└── ", "    "
+		}
+
+		folder := n.folders[name]
+		fmt.Fprintf(w, "%s%s%s\n", indent, branch, folder.summary())
+		folder.print(w, indent+next, files, depth-1)
+	}
+
+	if !files {
+		return
+	}
+
+	for i, item := range n.children {
+		branch := "├── "
+		if len(names)+i == lines-1 {
+			branch = "└── "
+		}
+
+		name := item.Key[strings.LastIndex(item.Key, "/")+1:]
+		fmt.Fprintf(w, "%s%s%s (%s)\n", indent, branch, name, humanSize(item.Size))
+	}
+}
+
+// printTree shows everything under prefix as folders with the number and
+// total size of the objects below them. depth limits the levels shown,
+// 0 shows all of them.
+func (s *S3pal) printTree(w io.Writer, prefix string, files bool, depth int) error {
+	listing, err := s.listDetailed(prefix, "", "", 0, false, 0)
+	if err != nil {
+		return err
+	}
+
+	// the tree starts at the folder the prefix is in
+	base := prefix[:strings.LastIndex(prefix, "/")+1]
+	name := base
+	if len(name) == 0 {
+		name = s.Config.Aws.Bucket + "/"
+	}
+
+	root := newTreeNode(name)
+	for _, item := range listing.Items {
+		root.add(item.Key[len(base):], item)
+	}
+
+	if depth <= 0 {
+		depth = -1
+	}
+
+	fmt.Fprintln(w, root.summary())
+	root.print(w, "", files, depth)
+
+	return nil
+}
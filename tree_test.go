@@ -0,0 +1,38 @@
+package main
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestPrintTree(t *testing.T) {
+	storage := newMemStorage()
+	storage.objects["uploads/2015/a.jpg"] = &memObject{data: make([]byte, 1024)}
+	storage.objects["uploads/2015/b.jpg"] = &memObject{data: make([]byte, 1024)}
+	storage.objects["uploads/2016/c.jpg"] = &memObject{data: make([]byte, 2048)}
+	storage.objects["uploads/d.txt"] = &memObject{data: make([]byte, 10)}
+	s3pal := getS3palWithStorage(storage)
+
+	var out bytes.Buffer
+	err := s3pal.printTree(&out, "uploads/", false, 0)
+	assert.Nil(t, err)
+
+	expected := `uploads/ (4 objects, 4.0 KB)
+├── 2015/ (2 objects, 2.0 KB)
+└── 2016/ (1 object, 2.0 KB)
+`
+	assert.Equal(t, expected, out.String())
+
+	out.Reset()
+	s3pal.printTree(&out, "uploads/20", true, 0)
+
+	expected = `uploads/ (3 objects, 4.0 KB)
+├── 2015/ (2 objects, 2.0 KB)
+│   ├── a.jpg (1.0 KB)
+│   └── b.jpg (1.0 KB)
+└── 2016/ (1 object, 2.0 KB)
+    └── c.jpg (2.0 KB)
+`
+	assert.Equal(t, expected, out.String())
+}
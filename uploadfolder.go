@@ -4,8 +4,11 @@ import (
 	"fmt"
 	"github.com/atotto/clipboard"
 	"gopkg.in/fsnotify.v1"
+	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
+	"sync"
 	"time"
 )
 
@@ -14,6 +17,12 @@ type FileReadyChecker struct {
 	LastFileDetails map[string]*FileDetails
 	Debug           bool
 	S3pal           *S3pal
+	State           *watchState
+	Filter          *watchFilter
+
+	mu sync.Mutex
+	// a slot for every upload running
+	uploads chan bool
 }
 
 type FileDetails struct {
@@ -41,66 +50,165 @@ func getFileDetails(path string) *FileDetails {
 	return result
 }
 
+// files being uploaded at the same time, a catch-up scan can find many
+const watchUploadConcurrency = 4
+
+// checkFile uploads path once its size stopped changing
 func (o *FileReadyChecker) checkFile(path string) {
+	if o.Filter.ignored(path, false) {
+		return
+	}
 
+	o.mu.Lock()
 	if val, ok := o.DelayTickChan[path]; ok {
 		val.Stop()
 	}
 
-	fwConfig := o.S3pal.Config.FolderWatchUpload
 	o.LastFileDetails[path] = getFileDetails(path)
 
 	//log.Println("Size now:", *o.LastFileDetails[path])
 
-	o.DelayTickChan[path] = time.NewTicker(2 * time.Second)
+	ticker := time.NewTicker(2 * time.Second)
+	o.DelayTickChan[path] = ticker
+	o.mu.Unlock()
 
 	go func() {
-		for {
-			select {
-			case <-o.DelayTickChan[path].C:
-				now := getFileDetails(path)
-
-				if now.Readable && now.Size == o.LastFileDetails[path].Size {
-					o.DelayTickChan[path].Stop()
-
-					newFilename, err := o.S3pal.uploadPathOrURL(path, fwConfig.Prefix)
-					if err == nil {
-
-						if fwConfig.AutoDeleteFile {
-							fmt.Printf("\nAuto deleting '%v'...", path)
-							err = os.Remove(path)
-							if err != nil {
-								fmt.Printf("Error! Not removed.")
-							} else {
-								fmt.Printf("Done.")
-							}
-						}
-
-						if fwConfig.AutoClipboard {
-							var toCopy string
-
-							if len(fwConfig.AutoClipboardPrefix) > 0 {
-								toCopy = fwConfig.AutoClipboardPrefix + newFilename
-							} else {
-								toCopy = o.S3pal.makeUrl(newFilename)
-							}
-
-							clipboard.WriteAll(toCopy)
-							fmt.Printf("\nAdded '%v' to your clipboard\n\n", toCopy)
-						}
+		for range ticker.C {
+			now := getFileDetails(path)
 
-					} else {
-						fmt.Printf("\nError uploading '%v'\n\n", path)
-					}
+			o.mu.Lock()
+			ready := now.Readable && now.Size == o.LastFileDetails[path].Size
+			o.LastFileDetails[path] = now
+			o.mu.Unlock()
 
-				} else {
-					o.LastFileDetails[path] = now
-				}
+			if ready {
+				ticker.Stop()
+
+				o.uploads <- true
+				o.uploadReady(path)
+				<-o.uploads
+				return
 			}
 		}
 	}()
 }
 
+// uploadReady uploads a file that is complete, unless its content was
+// uploaded already
+func (o *FileReadyChecker) uploadReady(path string) {
+	fwConfig := o.S3pal.Config.FolderWatchUpload
+
+	info, err := os.Stat(path)
+	if err != nil || info.IsDir() {
+		return
+	}
+
+	if problem := o.Filter.sizeProblem(info.Size()); len(problem) > 0 {
+		fmt.Printf("\nSkipping '%v', it is %s\n", path, problem)
+		return
+	}
+
+	entry, hash, err := o.State.find(path, info)
+	if err != nil {
+		fmt.Printf("\nError reading '%v': %v\n\n", path, err)
+		return
+	}
+
+	var newFilename string
+	if entry != nil {
+		newFilename = entry.Key
+		fmt.Printf("\nSkipping '%v', it was uploaded as '%v' already\n", path, newFilename)
+	} else {
+		fmt.Printf("\nUploading '%s' to S3 Bucket '%s'...\n", path, o.S3pal.Config.Aws.Bucket)
+		key := o.S3pal.makeFilenameIn(fwConfig.Prefix, o.relDir(path), filepath.Base(path))
+		newFilename, err = o.S3pal.uploadLocalFile(path, key, eventSource{Name: "watch-folder"})
+		if err != nil {
+			fmt.Printf("\nError uploading '%v'\n\n", path)
+			return
+		}
+	}
+
+	// a touched file (or a copy with dedupe_content) is remembered too, so
+	// it is not even hashed again until it changes
+	if !o.State.known(path, info) {
+		if err = o.State.record(path, info, hash, newFilename); err != nil {
+			fmt.Printf("\nError saving watch-folder state: %v\n", err)
+		}
+	}
+
+	if fwConfig.AutoDeleteFile {
+		fmt.Printf("\nAuto deleting '%v'...", path)
+		err = os.Remove(path)
+		if err != nil {
+			fmt.Printf("Error! Not removed.")
+		} else {
+			fmt.Printf("Done.")
+		}
+	}
+
+	if fwConfig.AutoClipboard {
+		var toCopy string
+
+		if len(fwConfig.AutoClipboardPrefix) > 0 {
+			toCopy = fwConfig.AutoClipboardPrefix + newFilename
+		} else {
+			toCopy = o.S3pal.makeUrl(newFilename)
+		}
+
+		clipboard.WriteAll(toCopy)
+		fmt.Printf("\nAdded '%v' to your clipboard\n\n", toCopy)
+	}
+}
+
+// relDir is the folder of path relative to the watched one, slash
+// separated and empty for files right in it
+func (o *FileReadyChecker) relDir(path string) string {
+	rel, err := filepath.Rel(o.S3pal.Config.FolderWatchUpload.Path, filepath.Dir(path))
+	if err != nil || rel == "." {
+		return ""
+	}
+
+	return filepath.ToSlash(rel)
+}
+
+// watchTree adds dir and every folder below it the filter does not ignore
+// to the watcher and returns the files already in them
+func watchTree(watcher *fsnotify.Watcher, dir string, filter *watchFilter) ([]string, error) {
+	var files []string
+
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() && path != dir && filter.ignored(path, true) {
+			return filepath.SkipDir
+		}
+
+		if !info.IsDir() {
+			files = append(files, path)
+			return nil
+		}
+
+		return watcher.Add(path)
+	})
+
+	return files, err
+}
+
+// newFolder starts watching a folder created (or moved) in the watched
+// one. Files can land in it before it is watched, they are checked too.
+func (o *FileReadyChecker) newFolder(watcher *fsnotify.Watcher, dir string) {
+	files, err := watchTree(watcher, dir, o.Filter)
+	if err != nil {
+		log.Println("error:", err)
+	}
+
+	for _, file := range files {
+		o.checkFile(file)
+	}
+}
+
 func (o *FileReadyChecker) startWatcher() {
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
@@ -113,24 +221,98 @@ func (o *FileReadyChecker) startWatcher() {
 		for {
 			select {
 			case event := <-watcher.Events:
-				if event.Op&fsnotify.Rename != fsnotify.Rename {
-					o.checkFile(event.Name)
+				if o.Filter != nil && o.Filter.isIgnoreFile(event.Name) {
+					if err := o.Filter.loadIgnoreFile(); err != nil {
+						log.Println("error:", err)
+					} else {
+						fmt.Printf("\nReloaded '%v'\n", event.Name)
+					}
+					continue
+				}
+
+				if event.Op&fsnotify.Rename == fsnotify.Rename || event.Op&fsnotify.Remove == fsnotify.Remove {
+					continue
 				}
 
+				if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+					if o.S3pal.Config.FolderWatchUpload.Recursive && event.Op&fsnotify.Create == fsnotify.Create && !o.Filter.ignored(event.Name, true) {
+						o.newFolder(watcher, event.Name)
+					}
+					continue
+				}
+
+				o.checkFile(event.Name)
+
 			case err := <-watcher.Errors:
 				log.Println("error:", err)
 			}
 		}
 	}()
 
-	err = watcher.Add(o.S3pal.Config.FolderWatchUpload.Path)
-	fmt.Printf("\nLooking for new files in '%v'...\n", o.S3pal.Config.FolderWatchUpload.Path)
+	var files []string
+	if o.S3pal.Config.FolderWatchUpload.Recursive {
+		files, err = watchTree(watcher, o.S3pal.Config.FolderWatchUpload.Path, o.Filter)
+		fmt.Printf("\nLooking for new files in '%v' and its subfolders...\n", o.S3pal.Config.FolderWatchUpload.Path)
+	} else {
+		err = watcher.Add(o.S3pal.Config.FolderWatchUpload.Path)
+		if err == nil {
+			files, err = folderFiles(o.S3pal.Config.FolderWatchUpload.Path)
+		}
+		fmt.Printf("\nLooking for new files in '%v'...\n", o.S3pal.Config.FolderWatchUpload.Path)
+	}
 	if err != nil {
 		log.Fatal(err)
 	}
+
+	if !o.S3pal.Config.FolderWatchUpload.NoCatchUp {
+		o.catchUp(files)
+	}
+
 	<-done
 }
 
+// folderFiles lists the files right in dir
+func folderFiles(dir string) ([]string, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []string
+	for _, info := range infos {
+		if !info.IsDir() {
+			files = append(files, filepath.Join(dir, info.Name()))
+		}
+	}
+
+	return files, nil
+}
+
+// catchUp uploads the files that arrived while watch-folder was not
+// running, which are all those not in the state yet
+func (o *FileReadyChecker) catchUp(files []string) {
+	var missed []string
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			continue
+		}
+
+		// uploadReady skips those with content uploaded already
+		if !o.State.known(file, info) {
+			missed = append(missed, file)
+		}
+	}
+
+	if len(missed) > 0 {
+		fmt.Printf("\n%d files were added while not watching, uploading them...\n", len(missed))
+	}
+
+	for _, file := range missed {
+		o.checkFile(file)
+	}
+}
+
 func (s *S3pal) startDropFolder() {
 	path := s.Config.FolderWatchUpload.Path
 	if len(path) == 0 {
@@ -149,10 +331,25 @@ func (s *S3pal) startDropFolder() {
 		return
 	}
 
-	o := FileReadyChecker{
+	state, err := s.loadWatchState()
+	if err != nil {
+		fmt.Printf("\nNot Running! %v\n\n", err)
+		return
+	}
+
+	filter, err := s.newWatchFilter()
+	if err != nil {
+		fmt.Printf("\nNot Running! %v\n\n", err)
+		return
+	}
+
+	o := &FileReadyChecker{
 		DelayTickChan:   map[string]*time.Ticker{},
 		LastFileDetails: map[string]*FileDetails{},
 		S3pal:           s,
+		State:           state,
+		Filter:          filter,
+		uploads:         make(chan bool, watchUploadConcurrency),
 	}
 
 	o.startWatcher()
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/fsnotify.v1"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+func TestWatchRelDir(t *testing.T) {
+	s3pal := getS3palWithStorage(newMemStorage())
+	s3pal.Config.FolderWatchUpload.Path = filepath.FromSlash("/home/jack/toS3")
+	o := &FileReadyChecker{S3pal: s3pal}
+
+	assert.Equal(t, "", o.relDir(filepath.FromSlash("/home/jack/toS3/cat.jpg")))
+	assert.Equal(t, "pets/cats", o.relDir(filepath.FromSlash("/home/jack/toS3/pets/cats/cat.jpg")))
+}
+
+func TestWatchTree(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "s3pal_watch_")
+	defer os.RemoveAll(dir)
+
+	os.MkdirAll(filepath.Join(dir, "a", "b"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "top.txt"), []byte("x"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "a", "b", "deep.txt"), []byte("x"), 0644)
+
+	watcher, _ := fsnotify.NewWatcher()
+	if watcher != nil {
+		defer watcher.Close()
+	}
+
+	files, err := watchTree(watcher, dir, nil)
+	assert.Nil(t, err)
+
+	sort.Strings(files)
+	assert.Equal(t, []string{filepath.Join(dir, "a", "b", "deep.txt"), filepath.Join(dir, "top.txt")}, files)
+}
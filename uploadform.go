@@ -6,7 +6,15 @@ import (
 
 func (s *S3pal) getUploadForm() string {
 
-	uploadEndpoint := "http://" + s.Config.Server.Host + ":" + strconv.Itoa(s.Config.Server.Port) + "/upload/file"
+	serverURL := "http://" + s.Config.Server.Host + ":" + strconv.Itoa(s.Config.Server.Port)
+	uploadEndpoint := serverURL + "/upload/file"
+	presignEndpoint := serverURL + "/upload/presign"
+	listEndpoint := serverURL + "/list"
+
+	directUpload := "false"
+	if s.directUpload() {
+		directUpload = "true"
+	}
 
 	return `<html>
  <title>s3pal uploader to ` + s.Config.Aws.Bucket + `</title>
@@ -39,32 +47,168 @@ func (s *S3pal) getUploadForm() string {
 		<div id="result"></div>
 	</div>
 
+	<div class="box" style="overflow:auto">
+		<h2>Browse</h2>
+		<p id="browse-path"></p>
+		<ul id="browse"></ul>
+	</div>
+
 	<script>
 		var uploadForm = document.getElementById("upload-form");
 
+		var directUpload = ` + directUpload + `;
+
+		var showResult = function(url) {
+			document.getElementById("msg").innerHTML = 'Done.';
+			var a = document.createElement("a");
+			a.href = url;
+			a.textContent = url;
+			document.getElementById('result').appendChild(a);
+		}
+
+		var showError = function(reason) {
+			document.getElementById("msg").textContent = 'Error: ' + reason;
+			uploadForm.style.display = '';
+		}
+
+		// ask the server for a POST policy, then send the file to the bucket
+		var doDirectUpload = function() {
+			var file = document.getElementById("file").files[0];
+			var params = new FormData();
+			params.append("filename", file.name);
+			params.append("prefix", uploadForm.elements["prefix"].value);
+			params.append("content_type", file.type);
+			params.append("size", file.size);
+
+			var xhr = new XMLHttpRequest();
+			xhr.onreadystatechange = function(e) {
+				if (xhr.readyState !== 4) {
+					return;
+				}
+
+				var presigned = JSON.parse(xhr.responseText);
+				if (presigned.status !== "ok") {
+					showError(presigned.reason);
+					return;
+				}
+
+				var uploadData = new FormData();
+				Object.keys(presigned.fields).forEach(function(name) {
+					uploadData.append(name, presigned.fields[name]);
+				});
+				uploadData.append("file", file);
+
+				var upload = new XMLHttpRequest();
+				upload.onreadystatechange = function(e) {
+					if (upload.readyState !== 4) {
+						return;
+					}
+
+					if (upload.status >= 200 && upload.status < 300) {
+						showResult(presigned.file_url);
+					} else {
+						showError(upload.status + ' from the bucket');
+					}
+				}
+				upload.open("POST", presigned.url, true);
+				upload.send(uploadData);
+			}
+			xhr.open("POST", "` + presignEndpoint + `", true);
+			xhr.send(params);
+		}
+
 		var doUpload = function() {
 			uploadForm.style.display = 'none';
 			document.getElementById("msg").innerHTML = 'Uploading...';
 
+			if (directUpload) {
+				doDirectUpload();
+				return;
+			}
+
 			var uploadData = new FormData(uploadForm);
 			var xhr = new XMLHttpRequest();
 
 			xhr.onreadystatechange = function(e) {
 				if (xhr.readyState === 4) {
-					document.getElementById("msg").innerHTML = 'Done.';
 					var json = JSON.parse(xhr.responseText);
-					var a = document.createElement("a");
-					a.href = json.url;
-					a.textContent = json.url;
-					document.getElementById('result').appendChild(a);
+					if (json.status !== "ok") {
+						showError(json.reason);
+						return;
+					}
+					showResult(json.url);
 				}
 			}
 			xhr.open("POST", "` + uploadEndpoint + `", true);
 
-			console.log(uploadData);
 			xhr.send(uploadData);
 		}
 
+		// with a cursor the next page is added to the list
+		var browse = function(prefix, cursor) {
+			var xhr = new XMLHttpRequest();
+
+			xhr.onreadystatechange = function(e) {
+				if (xhr.readyState !== 4) {
+					return;
+				}
+
+				var json = JSON.parse(xhr.responseText);
+				var list = document.getElementById("browse");
+
+				var addLink = function(text, onClick, href) {
+					var li = document.createElement("li");
+					var a = document.createElement("a");
+					a.textContent = text;
+					a.href = href || '#';
+					if (onClick) {
+						a.addEventListener("click", function(e) {
+							e.preventDefault();
+							onClick();
+						});
+					}
+					li.appendChild(a);
+					list.appendChild(li);
+					return li;
+				};
+
+				if (!cursor) {
+					list.innerHTML = '';
+					document.getElementById("browse-path").textContent = '/' + prefix;
+
+					if (prefix.length > 0) {
+						var parent = prefix.replace(/[^\/]*\/$/, '');
+						addLink('..', function() { browse(parent); });
+					}
+				}
+
+				(json.prefixes || []).forEach(function(p) {
+					addLink(p.substring(prefix.length), function() { browse(p); });
+				});
+
+				(json.items || []).forEach(function(item) {
+					addLink(item.key.substring(prefix.length), null, item.url);
+				});
+
+				if (json.next_cursor) {
+					var more = addLink('more...', function() {
+						list.removeChild(more);
+						browse(prefix, json.next_cursor);
+					});
+				}
+			}
+
+			var query = "?delimiter=/&detail=true&prefix=" + encodeURIComponent(prefix);
+			if (cursor) {
+				query += "&cursor=" + encodeURIComponent(cursor);
+			}
+
+			xhr.open("GET", "` + listEndpoint + `" + query, true);
+			xhr.send();
+		}
+
+		browse("");
+
 		uploadForm.addEventListener("change", function(e) {
 			doUpload();
 		});
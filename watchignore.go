@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// the file in the watched folder with gitignore style patterns of files
+// not to upload
+const watchIgnoreFile = ".s3palignore"
+
+// defaultWatchIgnore are files that are never wanted: editor swap and
+// backup files, OS metadata and downloads that are not finished
+var defaultWatchIgnore = []string{
+	".DS_Store",
+	"._*",
+	"Thumbs.db",
+	"desktop.ini",
+	"*.swp",
+	"*.swo",
+	"*.swx",
+	"*~",
+	".#*",
+	"#*#",
+	"*.tmp",
+	"*.crdownload",
+	"*.part",
+	"*.partial",
+	"*.download",
+	watchIgnoreFile,
+}
+
+// ignorePattern is a line of a .s3palignore file
+type ignorePattern struct {
+	re *regexp.Regexp
+	// a ! line, files it matches are not ignored after all
+	negate bool
+	// a line ending in /, only matches folders
+	dirOnly bool
+}
+
+// parseIgnorePattern turns a gitignore style line into a pattern, nil for
+// blank lines and comments
+func parseIgnorePattern(line string) *ignorePattern {
+	line = strings.TrimRight(line, " \t\r")
+	if len(line) == 0 || line[0] == '#' {
+		return nil
+	}
+
+	p := &ignorePattern{}
+	if line[0] == '!' {
+		p.negate = true
+		line = line[1:]
+	} else if line[0] == '\\' {
+		line = line[1:]
+	}
+
+	if strings.HasSuffix(line, "/") {
+		p.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+
+	if len(line) == 0 {
+		return nil
+	}
+
+	// with a slash anywhere but the end it is relative to the watched
+	// folder, otherwise it matches a name in any folder
+	anchored := strings.Contains(line, "/")
+	line = strings.TrimPrefix(line, "/")
+
+	var re string
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case strings.HasPrefix(line[i:], "**/"):
+			re += "(.*/)?"
+			i += 2
+		case strings.HasPrefix(line[i:], "/**") && i+3 == len(line):
+			re += "/.*"
+			i += 2
+		case strings.HasPrefix(line[i:], "**"):
+			re += ".*"
+			i++
+		case c == '*':
+			re += "[^/]*"
+		case c == '?':
+			re += "[^/]"
+		case c == '[':
+			end := strings.IndexByte(line[i+1:], ']')
+			if end < 0 {
+				re += `\[`
+				continue
+			}
+			class := line[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			re += "[" + class + "]"
+			i += end + 1
+		case c == '\\' && i+1 < len(line):
+			i++
+			re += regexp.QuoteMeta(line[i : i+1])
+		default:
+			re += regexp.QuoteMeta(line[i : i+1])
+		}
+	}
+
+	if anchored {
+		re = "^" + re + "$"
+	} else {
+		re = "^(.*/)?" + re + "$"
+	}
+
+	compiled, err := regexp.Compile(re)
+	if err != nil {
+		return nil
+	}
+	p.re = compiled
+
+	return p
+}
+
+func parseIgnorePatterns(lines []string) []*ignorePattern {
+	var patterns []*ignorePattern
+	for _, line := range lines {
+		if p := parseIgnorePattern(line); p != nil {
+			patterns = append(patterns, p)
+		}
+	}
+
+	return patterns
+}
+
+// ignoredPath applies patterns to rel, a slash separated path relative to
+// the watched folder, like git does: the last matching pattern wins and
+// nothing in an ignored folder can be brought back
+func ignoredPath(patterns []*ignorePattern, rel string, dir bool) bool {
+	parts := strings.Split(rel, "/")
+	for i := range parts {
+		p := strings.Join(parts[:i+1], "/")
+		isDir := dir || i < len(parts)-1
+
+		ignored := false
+		for _, pattern := range patterns {
+			if pattern.dirOnly && !isDir {
+				continue
+			}
+			if pattern.re.MatchString(p) {
+				ignored = !pattern.negate
+			}
+		}
+
+		if ignored {
+			return true
+		}
+	}
+
+	return false
+}
+
+// watchFilter decides which files in the watched folder are uploaded
+type watchFilter struct {
+	root string
+	// matchKey patterns
+	include []string
+	exclude []string
+	minSize int64
+	maxSize int64
+
+	mu       sync.Mutex
+	defaults []*ignorePattern
+	// from .s3palignore
+	patterns []*ignorePattern
+}
+
+func (s *S3pal) newWatchFilter() (*watchFilter, error) {
+	fwConfig := s.Config.FolderWatchUpload
+
+	f := &watchFilter{
+		root:    fwConfig.Path,
+		include: fwConfig.Include,
+		exclude: fwConfig.Exclude,
+		minSize: fwConfig.MinSize,
+		maxSize: fwConfig.MaxSize,
+	}
+
+	if !fwConfig.NoDefaultIgnore {
+		f.defaults = parseIgnorePatterns(defaultWatchIgnore)
+	}
+
+	if err := f.loadIgnoreFile(); err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// loadIgnoreFile (re)reads .s3palignore, a missing one ignores nothing
+func (f *watchFilter) loadIgnoreFile() error {
+	fd, err := os.Open(filepath.Join(f.root, watchIgnoreFile))
+	if os.IsNotExist(err) {
+		f.setPatterns(nil)
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(fd)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if err = scanner.Err(); err != nil {
+		return fmt.Errorf("could not read %s: %v", watchIgnoreFile, err)
+	}
+
+	f.setPatterns(parseIgnorePatterns(lines))
+	return nil
+}
+
+func (f *watchFilter) setPatterns(patterns []*ignorePattern) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.patterns = patterns
+}
+
+// isIgnoreFile is true for the .s3palignore of the watched folder
+func (f *watchFilter) isIgnoreFile(path string) bool {
+	return filepath.Clean(path) == filepath.Join(f.root, watchIgnoreFile)
+}
+
+func (f *watchFilter) rel(path string) string {
+	rel, err := filepath.Rel(f.root, path)
+	if err != nil {
+		return filepath.ToSlash(path)
+	}
+
+	return filepath.ToSlash(rel)
+}
+
+// ignored is true for files and folders skipped because of their names
+func (f *watchFilter) ignored(path string, dir bool) bool {
+	if f == nil {
+		return false
+	}
+
+	rel := f.rel(path)
+
+	f.mu.Lock()
+	patterns := f.patterns
+	f.mu.Unlock()
+
+	if ignoredPath(f.defaults, rel, dir) || ignoredPath(patterns, rel, dir) {
+		return true
+	}
+
+	// include and exclude are about files, folders are looked in
+	if dir {
+		return false
+	}
+
+	for _, pattern := range f.exclude {
+		if matchKey(pattern, rel) {
+			return true
+		}
+	}
+
+	if len(f.include) == 0 {
+		return false
+	}
+
+	for _, pattern := range f.include {
+		if matchKey(pattern, rel) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// sizeProblem says why a complete file is too small or too large, empty
+// when its size is fine
+func (f *watchFilter) sizeProblem(size int64) string {
+	if f == nil {
+		return ""
+	}
+
+	if f.minSize > 0 && size < f.minSize {
+		return fmt.Sprintf("smaller than min_size (%d bytes)", f.minSize)
+	}
+
+	if f.maxSize > 0 && size > f.maxSize {
+		return fmt.Sprintf("larger than max_size (%d bytes)", f.maxSize)
+	}
+
+	return ""
+}
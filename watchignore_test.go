@@ -0,0 +1,144 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/fsnotify.v1"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIgnoredPath(t *testing.T) {
+	patterns := parseIgnorePatterns([]string{
+		"# comment",
+		"",
+		"*.log",
+		"!keep.log",
+		"build/",
+		"/drafts",
+		"docs/**/*.psd",
+		"img?.png",
+		"[ab].txt",
+		`\#hash`,
+	})
+
+	tests := []struct {
+		rel     string
+		dir     bool
+		ignored bool
+	}{
+		{"server.log", false, true},
+		{"logs/server.log", false, true},
+		{"keep.log", false, false},
+		{"logs/keep.log", false, false},
+		{"build", true, true},
+		{"build/app.js", false, true},
+		{"src/build/app.js", false, true},
+		// build/ is for folders only
+		{"build", false, false},
+		{"drafts/cat.jpg", false, true},
+		{"old/drafts/cat.jpg", false, false},
+		{"docs/a/b/cover.psd", false, true},
+		{"docs/cover.psd", false, true},
+		{"cover.psd", false, false},
+		{"img1.png", false, true},
+		{"img10.png", false, false},
+		{"a.txt", false, true},
+		{"c.txt", false, false},
+		{"#hash", false, true},
+		{"cat.jpg", false, false},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.ignored, ignoredPath(patterns, test.rel, test.dir), test.rel)
+	}
+}
+
+func TestIgnoredPathNoBringingBack(t *testing.T) {
+	patterns := parseIgnorePatterns([]string{"tmp/", "!tmp/keep.txt"})
+	assert.True(t, ignoredPath(patterns, "tmp/keep.txt", false))
+}
+
+func TestWatchFilter(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "s3pal_watch_")
+	defer os.RemoveAll(dir)
+
+	s3pal := getS3palWithStorage(newMemStorage())
+	s3pal.Config.FolderWatchUpload.Path = dir
+	s3pal.Config.FolderWatchUpload.Include = []string{"*.jpg", "*.png"}
+	s3pal.Config.FolderWatchUpload.Exclude = []string{"secret*"}
+
+	f, err := s3pal.newWatchFilter()
+	assert.Nil(t, err)
+
+	assert.False(t, f.ignored(filepath.Join(dir, "cat.jpg"), false))
+	assert.False(t, f.ignored(filepath.Join(dir, "pets", "dog.png"), false))
+	assert.True(t, f.ignored(filepath.Join(dir, "notes.txt"), false))
+	assert.True(t, f.ignored(filepath.Join(dir, "secret.jpg"), false))
+	assert.False(t, f.ignored(filepath.Join(dir, "pets"), true))
+
+	// defaults
+	assert.True(t, f.ignored(filepath.Join(dir, ".DS_Store"), false))
+	assert.True(t, f.ignored(filepath.Join(dir, "cat.jpg.crdownload"), false))
+	assert.True(t, f.ignored(filepath.Join(dir, "cat.jpg.part"), false))
+	assert.True(t, f.ignored(filepath.Join(dir, ".cat.jpg.swp"), false))
+
+	// .s3palignore
+	ioutil.WriteFile(filepath.Join(dir, watchIgnoreFile), []byte("raw/\n"), 0644)
+	assert.True(t, f.isIgnoreFile(filepath.Join(dir, watchIgnoreFile)))
+	assert.False(t, f.ignored(filepath.Join(dir, "raw", "cat.jpg"), false))
+	assert.Nil(t, f.loadIgnoreFile())
+	assert.True(t, f.ignored(filepath.Join(dir, "raw", "cat.jpg"), false))
+	assert.True(t, f.ignored(filepath.Join(dir, "raw"), true))
+
+	os.Remove(filepath.Join(dir, watchIgnoreFile))
+	assert.Nil(t, f.loadIgnoreFile())
+	assert.False(t, f.ignored(filepath.Join(dir, "raw", "cat.jpg"), false))
+}
+
+func TestWatchFilterNoDefaults(t *testing.T) {
+	s3pal := getS3palWithStorage(newMemStorage())
+	s3pal.Config.FolderWatchUpload.Path = os.TempDir()
+	s3pal.Config.FolderWatchUpload.NoDefaultIgnore = true
+
+	f, err := s3pal.newWatchFilter()
+	assert.Nil(t, err)
+	assert.False(t, f.ignored(filepath.Join(os.TempDir(), ".DS_Store"), false))
+}
+
+func TestWatchFilterSize(t *testing.T) {
+	f := &watchFilter{minSize: 10, maxSize: 100}
+
+	assert.NotEmpty(t, f.sizeProblem(5))
+	assert.Empty(t, f.sizeProblem(10))
+	assert.Empty(t, f.sizeProblem(100))
+	assert.NotEmpty(t, f.sizeProblem(101))
+
+	var none *watchFilter
+	assert.Empty(t, none.sizeProblem(5))
+	assert.False(t, none.ignored("cat.jpg", false))
+}
+
+func TestWatchTreeIgnored(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "s3pal_watch_")
+	defer os.RemoveAll(dir)
+
+	os.MkdirAll(filepath.Join(dir, "node_modules", "x"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "node_modules", "x", "index.js"), []byte("x"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "top.txt"), []byte("x"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, watchIgnoreFile), []byte("node_modules/\n"), 0644)
+
+	s3pal := getS3palWithStorage(newMemStorage())
+	s3pal.Config.FolderWatchUpload.Path = dir
+	f, _ := s3pal.newWatchFilter()
+
+	watcher, _ := fsnotify.NewWatcher()
+	if watcher != nil {
+		defer watcher.Close()
+	}
+
+	files, err := watchTree(watcher, dir, f)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{filepath.Join(dir, watchIgnoreFile), filepath.Join(dir, "top.txt")}, files)
+}
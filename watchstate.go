@@ -0,0 +1,202 @@
+package main
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// watchState remembers what watch-folder uploaded, so files are not
+// uploaded again after a restart or when they are only touched.
+type watchState struct {
+	file string
+	mu   sync.Mutex
+	// find content uploaded from any path, not only the file's own
+	dedupeContent bool
+
+	Bucket string                      `json:"bucket"`
+	Root   string                      `json:"root"`
+	Files  map[string]*watchStateEntry `json:"files"`
+
+	// uploads by the hash of their content
+	byHash map[string]*watchStateEntry
+}
+
+type watchStateEntry struct {
+	Path       string    `json:"path"`
+	Size       int64     `json:"size"`
+	ModTime    time.Time `json:"mtime"`
+	Hash       string    `json:"hash"`
+	Key        string    `json:"key"`
+	UploadedAt time.Time `json:"uploaded_at"`
+}
+
+// watchStatePath is folderwatchupload.state_file or a file for the bucket
+// and folder in ~/.s3pal/watch
+func (s *S3pal) watchStatePath(root string) string {
+	if len(s.Config.FolderWatchUpload.StateFile) > 0 {
+		return s.Config.FolderWatchUpload.StateFile
+	}
+
+	dir := path.Join(os.TempDir(), "s3pal_watch")
+	if usr, err := user.Current(); err == nil {
+		dir = path.Join(usr.HomeDir, ".s3pal", "watch")
+	}
+
+	hash := sha1.New()
+	fmt.Fprintf(hash, "%s\n%s", s.Config.Aws.Bucket, root)
+	return path.Join(dir, hex.EncodeToString(hash.Sum(nil))+".json")
+}
+
+// loadWatchState reads the state of the watched folder, an empty one if
+// nothing was uploaded from it yet
+func (s *S3pal) loadWatchState() (*watchState, error) {
+	root, err := filepath.Abs(s.Config.FolderWatchUpload.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	state := &watchState{
+		file:          s.watchStatePath(root),
+		dedupeContent: s.Config.FolderWatchUpload.DedupeContent,
+		Bucket:        s.Config.Aws.Bucket,
+		Root:          root,
+		Files:         map[string]*watchStateEntry{},
+		byHash:        map[string]*watchStateEntry{},
+	}
+
+	data, err := ioutil.ReadFile(state.file)
+	if os.IsNotExist(err) {
+		return state, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err = json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("watch-folder state %s is broken: %v", state.file, err)
+	}
+
+	for _, entry := range state.Files {
+		state.byHash[entry.Hash] = entry
+	}
+
+	return state, nil
+}
+
+func hashFile(file string) (string, error) {
+	fd, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer fd.Close()
+
+	hash := sha256.New()
+	if _, err = io.Copy(hash, fd); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func (w *watchState) entry(file string) *watchStateEntry {
+	abs, err := filepath.Abs(file)
+	if err != nil {
+		return nil
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.Files[abs]
+}
+
+// known is true when the file was uploaded with its size and modification
+// time
+func (w *watchState) known(file string, info os.FileInfo) bool {
+	entry := w.entry(file)
+	return entry != nil && entry.Size == info.Size() && entry.ModTime.Equal(info.ModTime())
+}
+
+// find returns the entry of the upload the file was uploaded with
+// already, or nil and the hash of the content to record. A file that was
+// only touched is found by its content, which is not read when size and
+// modification time did not change. With dedupe_content the same content
+// at another path is found too.
+func (w *watchState) find(file string, info os.FileInfo) (*watchStateEntry, string, error) {
+	entry := w.entry(file)
+	if entry != nil && entry.Size == info.Size() && entry.ModTime.Equal(info.ModTime()) {
+		return entry, entry.Hash, nil
+	}
+
+	hash, err := hashFile(file)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if entry != nil && entry.Hash == hash {
+		return entry, hash, nil
+	}
+
+	if !w.dedupeContent {
+		return nil, hash, nil
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.byHash[hash], hash, nil
+}
+
+// record adds an upload and saves the state
+func (w *watchState) record(file string, info os.FileInfo, hash string, key string) error {
+	abs, err := filepath.Abs(file)
+	if err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	entry := &watchStateEntry{
+		Path:       abs,
+		Size:       info.Size(),
+		ModTime:    info.ModTime(),
+		Hash:       hash,
+		Key:        key,
+		UploadedAt: time.Now().UTC(),
+	}
+	w.Files[abs] = entry
+	w.byHash[hash] = entry
+
+	return w.save()
+}
+
+// save writes a temp file and renames it, so a crash can not leave half
+// a state behind
+func (w *watchState) save() error {
+	data, err := json.MarshalIndent(w, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(filepath.Dir(w.file), 0700); err != nil {
+		return err
+	}
+
+	tmp := w.file + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, w.file)
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestWatchState(t *testing.T) (*S3pal, string) {
+	dir, _ := ioutil.TempDir("", "s3pal_watchstate_")
+
+	s3pal := getS3palWithStorage(newMemStorage())
+	s3pal.Config.FolderWatchUpload.Path = filepath.Join(dir, "toS3")
+	s3pal.Config.FolderWatchUpload.StateFile = filepath.Join(dir, "state.json")
+	os.MkdirAll(s3pal.Config.FolderWatchUpload.Path, 0755)
+
+	return s3pal, dir
+}
+
+func TestWatchStateRecord(t *testing.T) {
+	s3pal, dir := newTestWatchState(t)
+	defer os.RemoveAll(dir)
+
+	state, err := s3pal.loadWatchState()
+	assert.Nil(t, err)
+
+	file := filepath.Join(s3pal.Config.FolderWatchUpload.Path, "cat.jpg")
+	ioutil.WriteFile(file, []byte("meow"), 0644)
+	info, _ := os.Stat(file)
+
+	entry, hash, err := state.find(file, info)
+	assert.Nil(t, err)
+	assert.Nil(t, entry)
+	assert.Len(t, hash, 64)
+	assert.False(t, state.known(file, info))
+
+	assert.Nil(t, state.record(file, info, hash, "2015/cat.jpg"))
+	assert.True(t, state.known(file, info))
+
+	// a restart reads it back
+	state, err = s3pal.loadWatchState()
+	assert.Nil(t, err)
+	assert.True(t, state.known(file, info))
+
+	entry, _, err = state.find(file, info)
+	assert.Nil(t, err)
+	if assert.NotNil(t, entry) {
+		assert.Equal(t, "2015/cat.jpg", entry.Key)
+	}
+}
+
+func TestWatchStateSameContent(t *testing.T) {
+	s3pal, dir := newTestWatchState(t)
+	defer os.RemoveAll(dir)
+
+	state, _ := s3pal.loadWatchState()
+
+	file := filepath.Join(s3pal.Config.FolderWatchUpload.Path, "cat.jpg")
+	ioutil.WriteFile(file, []byte("meow"), 0644)
+	info, _ := os.Stat(file)
+	_, hash, _ := state.find(file, info)
+	state.record(file, info, hash, "2015/cat.jpg")
+
+	// touched
+	later := time.Now().Add(time.Hour)
+	os.Chtimes(file, later, later)
+	info, _ = os.Stat(file)
+	assert.False(t, state.known(file, info))
+
+	entry, _, err := state.find(file, info)
+	assert.Nil(t, err)
+	if assert.NotNil(t, entry) {
+		assert.Equal(t, "2015/cat.jpg", entry.Key)
+	}
+
+	// copied, another file that is uploaded too
+	copied := filepath.Join(s3pal.Config.FolderWatchUpload.Path, "cat copy.jpg")
+	ioutil.WriteFile(copied, []byte("meow"), 0644)
+	copiedInfo, _ := os.Stat(copied)
+
+	entry, _, err = state.find(copied, copiedInfo)
+	assert.Nil(t, err)
+	assert.Nil(t, entry)
+
+	// unless content is deduped
+	state.dedupeContent = true
+	entry, _, err = state.find(copied, copiedInfo)
+	assert.Nil(t, err)
+	if assert.NotNil(t, entry) {
+		assert.Equal(t, "2015/cat.jpg", entry.Key)
+	}
+	state.dedupeContent = false
+
+	// changed
+	ioutil.WriteFile(file, []byte("woof"), 0644)
+	info, _ = os.Stat(file)
+
+	entry, _, err = state.find(file, info)
+	assert.Nil(t, err)
+	assert.Nil(t, entry)
+}
+
+func TestWatchStatePath(t *testing.T) {
+	s3pal := getS3palWithStorage(newMemStorage())
+	s3pal.Config.Aws.Bucket = "jack"
+
+	a := s3pal.watchStatePath("/home/jack/toS3")
+	assert.Equal(t, ".json", filepath.Ext(a))
+	assert.NotEqual(t, a, s3pal.watchStatePath("/home/jack/other"))
+
+	s3pal.Config.FolderWatchUpload.StateFile = "/tmp/state.json"
+	assert.Equal(t, "/tmp/state.json", s3pal.watchStatePath("/home/jack/toS3"))
+}
+
+func TestFolderFiles(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "s3pal_watch_")
+	defer os.RemoveAll(dir)
+
+	os.MkdirAll(filepath.Join(dir, "a"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "top.txt"), []byte("x"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "a", "deep.txt"), []byte("x"), 0644)
+
+	files, err := folderFiles(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{filepath.Join(dir, "top.txt")}, files)
+}
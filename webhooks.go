@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"code.google.com/p/go-uuid/uuid"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var webhookEvents = []string{"upload", "delete", "error"}
+
+const defaultWebhookAttempts = 5
+
+var (
+	// the wait before the second attempt, doubled for every further one
+	webhookRetryDelay    = time.Second
+	webhookMaxRetryDelay = 5 * time.Minute
+	webhookClient        = &http.Client{Timeout: 10 * time.Second}
+)
+
+// deliveries still running, waitWebhooks waits for them before the
+// command exits
+var webhookDeliveries sync.WaitGroup
+
+var deadLetterMu sync.Mutex
+
+// eventSource is where an upload or delete came from
+type eventSource struct {
+	// server, watch-folder or cli
+	Name     string
+	ClientIP string
+}
+
+var cliSource = eventSource{Name: "cli"}
+
+// webhookEvent is the JSON body webhooks get
+type webhookEvent struct {
+	ID          string `json:"id"`
+	Event       string `json:"event"`
+	Time        string `json:"time"`
+	Bucket      string `json:"bucket"`
+	Key         string `json:"key"`
+	URL         string `json:"url,omitempty"`
+	Size        int64  `json:"size,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	Source      string `json:"source"`
+	ClientIP    string `json:"client_ip,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+// deadLetter is a line of the dead letter file
+type deadLetter struct {
+	Webhook  string       `json:"webhook"`
+	Attempts int          `json:"attempts"`
+	Error    string       `json:"error"`
+	FailedAt string       `json:"failed_at"`
+	Event    webhookEvent `json:"event"`
+}
+
+// checkWebhookConfig catches typos in [[webhooks]]
+func (s *S3pal) checkWebhookConfig() error {
+	for i, hook := range s.Config.Webhooks {
+		if !strings.HasPrefix(hook.URL, "http://") && !strings.HasPrefix(hook.URL, "https://") {
+			return fmt.Errorf("webhooks #%d needs an http(s) url", i+1)
+		}
+
+		for _, event := range hook.Events {
+			if !StringInSlice(event, webhookEvents) {
+				return fmt.Errorf("unknown event '%s' in webhooks #%d, valid are: %s", event, i+1, strings.Join(webhookEvents, ", "))
+			}
+		}
+	}
+
+	return nil
+}
+
+func (hook WebhookConfig) wants(event webhookEvent) bool {
+	if len(hook.Events) > 0 && !StringInSlice(event.Event, hook.Events) {
+		return false
+	}
+
+	return strings.HasPrefix(event.Key, hook.Prefix)
+}
+
+func (hook WebhookConfig) deadLetterPath() string {
+	if len(hook.DeadLetter) > 0 {
+		return hook.DeadLetter
+	}
+
+	usr, err := user.Current()
+	if err != nil {
+		return path.Join(os.TempDir(), "s3pal_webhooks_dead_letter.jsonl")
+	}
+
+	return path.Join(usr.HomeDir, ".s3pal", "webhooks_dead_letter.jsonl")
+}
+
+// webhookSignature is sent as X-S3pal-Signature: sha256=<hex HMAC-SHA256
+// of the body with the webhook's secret>
+func webhookSignature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// notify sends event to every webhook that wants it, in the background.
+// ID, Time and Bucket are filled in when empty.
+func (s *S3pal) notify(event webhookEvent) {
+	if len(s.Config.Webhooks) == 0 {
+		return
+	}
+
+	if len(event.ID) == 0 {
+		event.ID = uuid.NewUUID().String()
+	}
+	if len(event.Time) == 0 {
+		event.Time = time.Now().UTC().Format(time.RFC3339)
+	}
+	if len(event.Bucket) == 0 {
+		event.Bucket = s.Config.Aws.Bucket
+	}
+
+	for _, hook := range s.Config.Webhooks {
+		if !hook.wants(event) {
+			continue
+		}
+
+		webhookDeliveries.Add(1)
+		go func(hook WebhookConfig) {
+			defer webhookDeliveries.Done()
+			deliverWebhook(hook, event)
+		}(hook)
+	}
+}
+
+// waitWebhooks blocks until every delivery succeeded or was given up on
+func waitWebhooks() {
+	webhookDeliveries.Wait()
+}
+
+// postWebhook makes one attempt. retry is false for answers that will not
+// change, like a 404.
+func postWebhook(hook WebhookConfig, event webhookEvent, body []byte) (retry bool, err error) {
+	req, err := http.NewRequest("POST", hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "s3pal webhooks")
+	req.Header.Set("X-S3pal-Event", event.Event)
+	req.Header.Set("X-S3pal-Delivery", event.ID)
+	if len(hook.Secret) > 0 {
+		req.Header.Set("X-S3pal-Signature", webhookSignature(hook.Secret, body))
+	}
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+
+	err = fmt.Errorf("%v returned by %v", resp.StatusCode, hook.URL)
+	return resp.StatusCode >= 500 || resp.StatusCode == 429, err
+}
+
+// deliverWebhook posts event until it is taken, waiting longer after
+// every failed attempt. Deliveries that never succeed are written to the
+// dead letter file.
+func deliverWebhook(hook WebhookConfig, event webhookEvent) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Webhook %s: %v\n", hook.URL, err)
+		return
+	}
+
+	attempts := hook.MaxAttempts
+	if attempts <= 0 {
+		attempts = defaultWebhookAttempts
+	}
+
+	delay := webhookRetryDelay
+	attempt := 1
+	for ; ; attempt++ {
+		retry, err := postWebhook(hook, event, body)
+		if err == nil {
+			return
+		}
+
+		if !retry || attempt >= attempts {
+			log.Printf("Webhook %s gave up on %s %s after %d attempts: %v\n", hook.URL, event.Event, event.Key, attempt, err)
+			writeDeadLetter(hook, deadLetter{
+				Webhook:  hook.URL,
+				Attempts: attempt,
+				Error:    err.Error(),
+				FailedAt: time.Now().UTC().Format(time.RFC3339),
+				Event:    event,
+			})
+			return
+		}
+
+		time.Sleep(delay)
+		delay *= 2
+		if delay > webhookMaxRetryDelay {
+			delay = webhookMaxRetryDelay
+		}
+	}
+}
+
+func writeDeadLetter(hook WebhookConfig, letter deadLetter) {
+	deadLetterMu.Lock()
+	defer deadLetterMu.Unlock()
+
+	file := hook.deadLetterPath()
+	data, _ := json.Marshal(letter)
+
+	err := os.MkdirAll(filepath.Dir(file), 0700)
+	if err == nil {
+		var fd *os.File
+		fd, err = os.OpenFile(file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err == nil {
+			_, err = fd.Write(append(data, '\n'))
+			fd.Close()
+		}
+	}
+
+	if err != nil {
+		log.Printf("Webhook %s: could not write dead letter to %s: %v %s\n", hook.URL, file, err, data)
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookReceiver answers with the codes in order, then 200
+type webhookReceiver struct {
+	mu       sync.Mutex
+	codes    []int
+	events   []webhookEvent
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+func (r *webhookReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	body, _ := ioutil.ReadAll(req.Body)
+	r.requests = append(r.requests, req)
+	r.bodies = append(r.bodies, body)
+
+	code := 200
+	if len(r.codes) > 0 {
+		code, r.codes = r.codes[0], r.codes[1:]
+	}
+	if code == 200 {
+		var event webhookEvent
+		json.Unmarshal(body, &event)
+		r.events = append(r.events, event)
+	}
+
+	w.WriteHeader(code)
+}
+
+func webhookTest(t *testing.T, receiver *webhookReceiver, hooks ...WebhookConfig) (*S3pal, *memStorage, string, func()) {
+	server := httptest.NewServer(receiver)
+	dir, _ := ioutil.TempDir("", "s3pal_webhooks_")
+
+	for i := range hooks {
+		hooks[i].URL = server.URL + hooks[i].URL
+		hooks[i].DeadLetter = filepath.Join(dir, "dead.jsonl")
+	}
+
+	storage := newMemStorage()
+	s3pal := getS3palWithStorage(storage)
+	s3pal.Config.Aws.Bucket = "mybucket"
+	s3pal.Config.Webhooks = hooks
+
+	delay := webhookRetryDelay
+	webhookRetryDelay = time.Millisecond
+
+	return s3pal, storage, dir, func() {
+		waitWebhooks()
+		webhookRetryDelay = delay
+		server.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestWebhookUpload(t *testing.T) {
+	receiver := &webhookReceiver{}
+	s3pal, _, dir, cleanup := webhookTest(t, receiver,
+		WebhookConfig{URL: "/all", Secret: "shh"},
+		WebhookConfig{URL: "/pics", Prefix: "pics/", Events: []string{"upload"}},
+		WebhookConfig{URL: "/deletes", Events: []string{"delete"}},
+	)
+	defer cleanup()
+
+	file := filepath.Join(dir, "cat.txt")
+	ioutil.WriteFile(file, []byte("hello"), 0644)
+
+	assert.Nil(t, s3pal.uploadToS3(file, "text/plain", "docs/cat.txt", eventSource{Name: "server", ClientIP: "10.0.0.1"}))
+	waitWebhooks()
+
+	assert.Equal(t, 1, len(receiver.events))
+	event := receiver.events[0]
+	assert.Equal(t, "upload", event.Event)
+	assert.Equal(t, "mybucket", event.Bucket)
+	assert.Equal(t, "docs/cat.txt", event.Key)
+	assert.Equal(t, s3pal.makeUrl("docs/cat.txt"), event.URL)
+	assert.Equal(t, int64(5), event.Size)
+	assert.Equal(t, "text/plain", event.ContentType)
+	assert.Equal(t, "server", event.Source)
+	assert.Equal(t, "10.0.0.1", event.ClientIP)
+	assert.True(t, len(event.ID) > 0)
+
+	req := receiver.requests[0]
+	assert.Equal(t, "/all", req.URL.Path)
+	assert.Equal(t, "upload", req.Header.Get("X-S3pal-Event"))
+	assert.Equal(t, event.ID, req.Header.Get("X-S3pal-Delivery"))
+	assert.Equal(t, webhookSignature("shh", receiver.bodies[0]), req.Header.Get("X-S3pal-Signature"))
+
+	assert.Nil(t, s3pal.uploadToS3(file, "text/plain", "pics/cat.txt", cliSource))
+	waitWebhooks()
+	assert.Equal(t, 3, len(receiver.events))
+}
+
+func TestWebhookDeleteAndError(t *testing.T) {
+	receiver := &webhookReceiver{}
+	s3pal, storage, _, cleanup := webhookTest(t, receiver, WebhookConfig{URL: "/"})
+	defer cleanup()
+
+	storage.objects["a.txt"] = &memObject{}
+	storage.objects["b.txt"] = &memObject{}
+
+	deleted, err := s3pal.deleteKeys([]string{"a.txt", "b.txt"}, ioutil.Discard)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, deleted)
+
+	err = s3pal.uploadToS3("/does/not/exist", "", "c.txt", cliSource)
+	assert.NotNil(t, err)
+	waitWebhooks()
+
+	events := map[string]string{}
+	for _, event := range receiver.events {
+		events[event.Key] = event.Event
+		assert.Equal(t, "cli", event.Source)
+	}
+	assert.Equal(t, map[string]string{"a.txt": "delete", "b.txt": "delete", "c.txt": "error"}, events)
+}
+
+func TestWebhookRetries(t *testing.T) {
+	receiver := &webhookReceiver{codes: []int{500, 503}}
+	s3pal, _, dir, cleanup := webhookTest(t, receiver, WebhookConfig{URL: "/"})
+	defer cleanup()
+
+	s3pal.notify(webhookEvent{Event: "delete", Key: "a.txt"})
+	waitWebhooks()
+
+	assert.Equal(t, 3, len(receiver.requests))
+	assert.Equal(t, 1, len(receiver.events))
+	// every attempt is the same delivery
+	assert.Equal(t, receiver.bodies[0], receiver.bodies[2])
+
+	_, err := os.Stat(filepath.Join(dir, "dead.jsonl"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestWebhookDeadLetter(t *testing.T) {
+	receiver := &webhookReceiver{codes: []int{500, 500, 404}}
+	s3pal, _, dir, cleanup := webhookTest(t, receiver, WebhookConfig{URL: "/", MaxAttempts: 2})
+	defer cleanup()
+
+	s3pal.notify(webhookEvent{Event: "delete", Key: "a.txt"})
+	waitWebhooks()
+	// a 404 is not retried
+	s3pal.notify(webhookEvent{Event: "delete", Key: "b.txt"})
+	waitWebhooks()
+
+	assert.Equal(t, 3, len(receiver.requests))
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "dead.jsonl"))
+	assert.Nil(t, err)
+
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	assert.Equal(t, 2, len(lines))
+
+	var letter deadLetter
+	assert.Nil(t, json.Unmarshal([]byte(lines[0]), &letter))
+	assert.Equal(t, 2, letter.Attempts)
+	assert.Equal(t, "a.txt", letter.Event.Key)
+	assert.Contains(t, letter.Error, "500")
+
+	assert.Nil(t, json.Unmarshal([]byte(lines[1]), &letter))
+	assert.Equal(t, 1, letter.Attempts)
+	assert.Equal(t, "b.txt", letter.Event.Key)
+}
+
+func TestCheckWebhookConfig(t *testing.T) {
+	s3pal := getS3palWithStorage(newMemStorage())
+	s3pal.Config.Webhooks = []WebhookConfig{{URL: "https://example.com/hook", Events: []string{"upload", "error"}}}
+	assert.Nil(t, s3pal.checkWebhookConfig())
+
+	s3pal.Config.Webhooks[0].Events = []string{"uploaded"}
+	assert.NotNil(t, s3pal.checkWebhookConfig())
+
+	s3pal.Config.Webhooks[0] = WebhookConfig{URL: "example.com"}
+	assert.NotNil(t, s3pal.checkWebhookConfig())
+}